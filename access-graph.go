@@ -2,9 +2,10 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
@@ -18,14 +19,45 @@ import (
 type AccessGraph struct {
 	// Caller is the caller of an AWS service (STS).
 	Caller *sts.GetCallerIdentityOutput
-	// User is the AWS user (IAM).
+	// User is the AWS user (IAM), nil if the caller is not an IAM user,
+	// for example when using AWS SSO or an assumed role.
 	User *iam.User
-	// KubeConfig is the Kubernetes client configuration.
+	// KubeConfig is the Kubernetes client configuration. With several
+	// clusters, it holds the contexts of all of them.
 	KubeConfig *Config
+	// KubeContexts are the names of the clusters the Kubernetes-related info
+	// has been collected from, which prefix the keys of Kubernetes objects
+	// as in CLUSTER/NAMESPACE:NAME. Empty if only a single cluster is used.
+	KubeContexts []string
+	// Accounts are the AWS accounts the IAM-related info has been collected
+	// from, keyed by account ID. The IAM-related collections are keyed by
+	// ARN and so hold the entities of all accounts.
+	Accounts map[string]Account
 	// Roles is the collection of all IAM roles pertinent to user/caller.
 	Roles map[string]iam.Role
+	// RolePolicies is the collection of managed and inline policies attached
+	// to each of the IAM roles, keyed by role ARN.
+	RolePolicies map[string]RolePolicies
 	// Policies is the collection of all IAM policies pertinent to user/caller.
 	Policies map[string]iam.Policy
+	// PolicyAttachments is the number of entities each IAM policy is attached
+	// to, keyed by policy ARN and account ID. AWS managed policies are shared
+	// by all accounts, with an attachment count per account, so the one in
+	// Policies is only that of an arbitrary account.
+	PolicyAttachments map[string]map[string]int64
+	// PolicyDocuments is the collection of the documents of the default
+	// version of each IAM policy, keyed by policy ARN.
+	PolicyDocuments map[string]PolicyDocument
+	// PolicyDocumentErrors records why the documents of policies couldn't be
+	// fetched or parsed, keyed by policy ARN. Such policies have no entry in
+	// PolicyDocuments.
+	PolicyDocumentErrors map[string]string
+	// InstanceProfiles is the collection of all IAM instance profiles,
+	// keyed by instance profile ARN.
+	InstanceProfiles map[string]iam.InstanceProfile
+	// Instances is the collection of all EC2 instances, keyed by their
+	// account and private IP address, see instanceKey().
+	Instances map[string]ec2.Instance
 	// ServiceAccounts is the collection of all service accounts in the
 	// Kubernetes cluster.
 	ServiceAccounts map[string]ServiceAccount
@@ -33,51 +65,144 @@ type AccessGraph struct {
 	Secrets map[string]Secret
 	// Pods is the collection of all pods in the Kubernetes cluster.
 	Pods map[string]Pod
+	// KubeRoles is the collection of all roles in the Kubernetes cluster.
+	KubeRoles map[string]Role
+	// KubeClusterRoles is the collection of all cluster roles in the
+	// Kubernetes cluster, keyed by name.
+	KubeClusterRoles map[string]ClusterRole
+	// KubeRoleBindings is the collection of all role bindings in the
+	// Kubernetes cluster.
+	KubeRoleBindings map[string]RoleBinding
+	// KubeClusterRoleBindings is the collection of all cluster role bindings
+	// in the Kubernetes cluster, keyed by name.
+	KubeClusterRoleBindings map[string]ClusterRoleBinding
+	// AWSAuth is the mapping of IAM roles and users to Kubernetes users and
+	// groups, as defined in the aws-auth config map, keyed by cluster name.
+	AWSAuth map[string]*AWSAuth
+	// Snapshot describes the dump the access graph has been loaded from, nil
+	// if it has been collected from IAM and Kubernetes. It's part of the
+	// envelope of dumps rather than of the access graph, see DumpEnvelope.
+	Snapshot *SnapshotInfo `json:"-"`
+	// mu guards the access graph while collectors add to it concurrently.
+	mu sync.Mutex
+	// irsa caches the IRSA links, computed once, and irsaIndex the links
+	// by service account key and role ARN, see irsaLinks().
+	irsa      []IRSALink
+	irsaIndex map[string][]IRSALink
+	irsaOnce  sync.Once
+	// prev is the access graph of the last sync while refreshing, which
+	// allows to reuse IAM info that hasn't changed since, see refresh().
+	prev *AccessGraph
 }
 
 // NewAccessGraph a new access graph for the currently authenticated AWS user,
-// retrieving IAM-related as well as Kubernetes-related info. We try to be as
-// graceful as possbile here but if the IAM queries fail, there's no point in
-// continuing and we exit early.
-func NewAccessGraph(cfg aws.Config) *AccessGraph {
-	ag := &AccessGraph{}
-	err := ag.user(cfg)
-	if err != nil {
-		fmt.Printf("Can't get user: %v", err.Error())
-		os.Exit(2)
-	}
-	err = ag.callerIdentity(cfg)
-	if err != nil {
-		fmt.Printf("Can't get caller identity: %v", err.Error())
-		os.Exit(2)
-	}
-	err = ag.roles(cfg)
-	if err != nil {
-		fmt.Printf("Can't get roles: %v", err.Error())
-		os.Exit(2)
-	}
-	err = ag.policies(cfg)
-	if err != nil {
-		fmt.Printf("Can't get policies: %v", err.Error())
-		os.Exit(2)
-	}
-	err = ag.kubeIdentity()
-	if err != nil {
-		fmt.Printf("Can't get Kubernetes identity: %v", err.Error())
-	}
-	err = ag.kubeServiceAccounts()
-	if err != nil {
-		fmt.Printf("Can't get Kubernetes service accounts: %v", err.Error())
+// retrieving IAM-related as well as Kubernetes-related info from the
+// respective sources. The IAM sources are keyed by how the account is
+// accessed, with the empty key for the caller's own account, and the
+// Kubernetes sources are keyed by cluster name. We try to be as graceful
+// as possbile here: failing collectors are recorded in the report returned
+// along with the (partial) access graph, and only if the IAM queries of the
+// caller's own account fail the access graph is unusable, see also
+// CollectionReport.err(). Accounts, clusters and independent collectors
+// are queried concurrently, with the sources bounding the number of
+// concurrent requests, see limitSources().
+func NewAccessGraph(iamsrcs map[string]IAMSource, kubesrcs map[string]KubeSource) (*AccessGraph, *CollectionReport) {
+	return collect(nil, iamsrcs, kubesrcs)
+}
+
+// refresh creates a new access graph like NewAccessGraph() does, however
+// it reuses the documents of the policies whose default version and update
+// date didn't change since ag has been collected, which is the only change
+// IAM reliably tells us about. Note that this is all it saves: all roles,
+// policies and instance profiles, the attached and inline policies of each
+// role and all Kubernetes objects are listed again, so it costs about as
+// many requests as NewAccessGraph() minus the policy documents. The
+// resource versions of Kubernetes objects only serve to report what changed,
+// see deltas().
+func (ag *AccessGraph) refresh(iamsrcs map[string]IAMSource, kubesrcs map[string]KubeSource) (*AccessGraph, *CollectionReport) {
+	return collect(ag, iamsrcs, kubesrcs)
+}
+
+// collect builds an access graph from the sources, reusing unchanged IAM
+// info of the previous access graph prev, if not nil.
+func collect(prev *AccessGraph, iamsrcs map[string]IAMSource, kubesrcs map[string]KubeSource) (*AccessGraph, *CollectionReport) {
+	start := time.Now()
+	ag := &AccessGraph{prev: prev}
+	report := &CollectionReport{}
+	clusters := sortedSources(kubesrcs)
+	if len(clusters) > 1 || (len(clusters) == 1 && clusters[0] != "") {
+		ag.KubeContexts = clusters
 	}
-	err = ag.kubeSecrets()
-	if err != nil {
-		fmt.Printf("Can't get Kubernetes secrets: %v", err.Error())
+	fns := []func(){}
+	for _, via := range sortedAccounts(iamsrcs) {
+		via := via
+		fns = append(fns, func() {
+			ag.account(via, iamsrcs[via], report)
+		})
 	}
-	err = ag.kubePods()
-	if err != nil {
-		fmt.Printf("Can't get Kubernetes pods: %v", err.Error())
+	for _, cluster := range clusters {
+		cluster := cluster
+		fns = append(fns, func() {
+			ag.kube(cluster, kubesrcs[cluster], report)
+		})
 	}
-	return ag
+	concurrently(fns...)
+	ag.prev = nil
+	report.finish(start)
+	return ag, report
+}
+
+// kube retrieves the Kubernetes-related info of the cluster with the given
+// name from kubesrc, recording the outcome of each collector in report.
+// The collectors run concurrently and failures don't stop the collection.
+func (ag *AccessGraph) kube(cluster string, kubesrc KubeSource, report *CollectionReport) {
+	concurrently(
+		func() {
+			report.run("Kubernetes identity", cluster, false, func() error {
+				return ag.kubeIdentity(kubesrc)
+			})
+		},
+		func() {
+			report.run("Kubernetes service accounts", cluster, false, func() error {
+				return ag.kubeServiceAccounts(cluster, kubesrc)
+			})
+		},
+		func() {
+			report.run("Kubernetes secrets", cluster, false, func() error {
+				return ag.kubeSecrets(cluster, kubesrc)
+			})
+		},
+		func() {
+			report.run("Kubernetes pods", cluster, false, func() error {
+				return ag.kubePods(cluster, kubesrc)
+			})
+		},
+		func() {
+			report.run("Kubernetes roles", cluster, false, func() error {
+				return ag.kubeRoles(cluster, kubesrc)
+			})
+		},
+		func() {
+			report.run("Kubernetes cluster roles", cluster, false, func() error {
+				return ag.kubeClusterRoles(cluster, kubesrc)
+			})
+		},
+		func() {
+			report.run("Kubernetes role bindings", cluster, false, func() error {
+				return ag.kubeRoleBindings(cluster, kubesrc)
+			})
+		},
+		func() {
+			report.run("Kubernetes cluster role bindings", cluster, false, func() error {
+				return ag.kubeClusterRoleBindings(cluster, kubesrc)
+			})
+		},
+		func() {
+			report.run("aws-auth config map", cluster, false, func() error {
+				return ag.kubeAWSAuth(cluster, kubesrc)
+			})
+		},
+	)
 }
 
 // String provides a textual rendering of the access graph
@@ -101,3 +226,30 @@ func (ag *AccessGraph) String() string {
 		ag.Pods,
 	)
 }
+
+// summary provides a textual rendering of how many entities of each kind
+// have been fetched into the access graph.
+func (ag *AccessGraph) summary() string {
+	accounts := ""
+	if len(ag.Accounts) > 1 {
+		accounts = fmt.Sprintf(" across %v AWS accounts", len(ag.Accounts))
+	}
+	return fmt.Sprintf(
+		"Fetched %v IAM roles, %v IAM policies, %v IAM instance profiles, "+
+			"%v EC2 instances, "+
+			"%v Kubernetes service accounts, %v secrets, %v pods, "+
+			"%v roles, %v cluster roles, %v role bindings and %v cluster role bindings%v.\n",
+		len(ag.Roles),
+		len(ag.Policies),
+		len(ag.InstanceProfiles),
+		len(ag.Instances),
+		len(ag.ServiceAccounts),
+		len(ag.Secrets),
+		len(ag.Pods),
+		len(ag.KubeRoles),
+		len(ag.KubeClusterRoles),
+		len(ag.KubeRoleBindings),
+		len(ag.KubeClusterRoleBindings),
+		accounts,
+	)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/aws/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// accountID matches a bare AWS account ID as used in trust policies.
+var accountID = regexp.MustCompile(`^[0-9]{12}$`)
+
+// Account represents an AWS account the IAM-related info has been
+// collected from.
+type Account struct {
+	// ID is the AWS account ID.
+	ID string `json:"id"`
+	// Via is how the account has been accessed: empty for the default AWS
+	// config, otherwise the name of the profile or the ARN of the role assumed.
+	Via string `json:"via,omitempty"`
+	// Caller is the identity used to query the account.
+	Caller *sts.GetCallerIdentityOutput `json:"caller"`
+}
+
+// iamSources sets up the IAM sources to collect from, keyed by how the
+// account is accessed. By default that's only the AWS config cfg, with an
+// empty key. Additional accounts can be provided via the environment
+// variables RBIAM_AWS_PROFILES, a comma-separated list of profiles of the
+// shared AWS config, and RBIAM_ASSUME_ROLES, a comma-separated list of ARNs
+// of roles to assume with the credentials of cfg.
+func iamSources(cfg aws.Config) map[string]IAMSource {
+	srcs := map[string]IAMSource{"": awsSource{cfg: cfg}}
+	for _, profile := range splitList(os.Getenv("RBIAM_AWS_PROFILES")) {
+		pcfg, err := external.LoadDefaultAWSConfig(external.WithSharedConfigProfile(profile))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't load AWS config for profile %v: %v\n", profile, err.Error())
+			continue
+		}
+		srcs[profile] = awsSource{cfg: withRetries(pcfg)}
+	}
+	for _, rolearn := range splitList(os.Getenv("RBIAM_ASSUME_ROLES")) {
+		rcfg := cfg.Copy()
+		provider := stscreds.NewAssumeRoleProvider(sts.New(cfg), rolearn)
+		provider.RoleSessionName = "rbiam"
+		rcfg.Credentials = provider
+		srcs[rolearn] = awsSource{cfg: rcfg}
+	}
+	return srcs
+}
+
+// splitList splits a comma-separated list, dropping empty elements.
+func splitList(list string) []string {
+	res := []string{}
+	for _, e := range strings.Split(list, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// account retrieves the IAM-related info of the account src gives access
+// to and adds it to the access graph, with via being how the account is
+// accessed, empty for the caller's own account. The IAM-related maps are
+// keyed by ARN, so entities of several accounts can live side by side.
+// The outcome of each collector is recorded in report, with the caller,
+// roles and policies of the caller's own account being required. Once we know the caller,
+// the collectors run concurrently, apart from the role policies and policy
+// documents, which need the roles and policies.
+func (ag *AccessGraph) account(via string, src IAMSource, report *CollectionReport) {
+	required := via == ""
+	var caller *sts.GetCallerIdentityOutput
+	err := report.run("caller identity", via, required, func() error {
+		var err error
+		caller, err = src.CallerIdentity()
+		return err
+	})
+	if err != nil {
+		return
+	}
+	account := *caller.Account
+	scope := "account " + account
+	ag.mu.Lock()
+	if ag.Accounts == nil {
+		ag.Accounts = make(map[string]Account)
+	}
+	ag.Accounts[account] = Account{ID: account, Via: via, Caller: caller}
+	if required {
+		ag.Caller = caller
+		scope = ""
+	}
+	ag.mu.Unlock()
+	// only the roles and policies are required, without their attachments,
+	// documents or instance profiles the access graph is incomplete but
+	// still usable:
+	fns := []func(){
+		func() {
+			concurrently(
+				func() {
+					report.run("IAM roles", scope, required, func() error {
+						return ag.roles(src)
+					})
+				},
+				func() {
+					report.run("IAM policies", scope, required, func() error {
+						return ag.policies(src, account)
+					})
+				},
+			)
+			concurrently(
+				func() {
+					report.run("IAM role policies", scope, false, func() error {
+						return ag.rolePolicies(src, account)
+					})
+				},
+				func() {
+					report.run("IAM policy documents", scope, false, func() error {
+						return ag.policyDocuments(src, account)
+					})
+				},
+			)
+		},
+		func() {
+			report.run("IAM instance profiles", scope, false, func() error {
+				return ag.instanceProfiles(src)
+			})
+		},
+		func() {
+			report.run("EC2 instances", scope, false, func() error {
+				return ag.instances(src, account)
+			})
+		},
+	}
+	// the IAM user is optional, for example with AWS SSO or an assumed role
+	// there's none and we use the role of the caller instead:
+	if kind, _, _ := callerKind(*caller.Arn); required && kind == callerUser {
+		fns = append(fns, func() {
+			report.run("IAM user", "", false, func() error {
+				return ag.user(src)
+			})
+		})
+	}
+	concurrently(fns...)
+}
+
+// sortedAccounts returns the keys of the IAM sources in alphabetical order,
+// which means the default AWS config, with its empty key, comes first.
+func sortedAccounts(srcs map[string]IAMSource) []string {
+	vias := []string{}
+	for via := range srcs {
+		vias = append(vias, via)
+	}
+	sort.Strings(vias)
+	return vias
+}
+
+// principalAccount returns the AWS account ID of a principal in a trust
+// policy, which can be given as ARN or as bare account ID, or an empty
+// string for principals that don't belong to an account, such as services.
+func principalAccount(tr TrustRelationship) string {
+	if tr.PrincipalType != "AWS" {
+		return ""
+	}
+	if accountID.MatchString(tr.Principal) {
+		return tr.Principal
+	}
+	return arnAccount(tr.Principal)
+}
+
+// roleTrust returns the trust relationships of the role, flagging the ones
+// whose principal is in a different account than the role.
+func roleTrust(role iam.Role) ([]TrustRelationship, error) {
+	trs, err := trustRelationships(*role.AssumeRolePolicyDocument)
+	if err != nil {
+		return nil, err
+	}
+	roleaccount := arnAccount(*role.Arn)
+	for i, tr := range trs {
+		if account := principalAccount(tr); account != "" && account != roleaccount {
+			trs[i].CrossAccount = true
+		}
+	}
+	return trs, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// AWSAuth represents the content of the aws-auth config map in the
+// kube-system namespace, which EKS uses to map IAM roles and users to
+// Kubernetes users and groups, see also:
+// https://docs.aws.amazon.com/eks/latest/userguide/add-user-role.html
+type AWSAuth struct {
+	// MapRoles maps IAM roles to Kubernetes users and groups.
+	MapRoles []RoleMapping `json:"mapRoles,omitempty"`
+	// MapUsers maps IAM users to Kubernetes users and groups.
+	MapUsers []UserMapping `json:"mapUsers,omitempty"`
+	// MapAccounts lists AWS accounts whose IAM users and roles are
+	// automatically mapped, using their ARN as the Kubernetes user name.
+	MapAccounts []string `json:"mapAccounts,omitempty"`
+}
+
+// RoleMapping maps an IAM role to a Kubernetes user and groups.
+type RoleMapping struct {
+	RoleARN  string   `json:"rolearn"`
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+	// Cluster is the name of the cluster the mapping applies to, empty
+	// unless the access graph spans several clusters.
+	Cluster string `json:"cluster,omitempty"`
+}
+
+// UserMapping maps an IAM user to a Kubernetes user and groups.
+type UserMapping struct {
+	UserARN  string   `json:"userarn"`
+	Username string   `json:"username"`
+	Groups   []string `json:"groups,omitempty"`
+	// Cluster is the name of the cluster the mapping applies to, empty
+	// unless the access graph spans several clusters.
+	Cluster string `json:"cluster,omitempty"`
+}
+
+// kubeAWSAuth retrieves and parses the aws-auth config map of the cluster.
+func (ag *AccessGraph) kubeAWSAuth(cluster string, src KubeSource) error {
+	cm, err := src.ConfigMap("kube-system", "aws-auth")
+	if err != nil {
+		return err
+	}
+	awsauth, err := parseAWSAuth(cm)
+	if err != nil {
+		return err
+	}
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.AWSAuth == nil {
+		ag.AWSAuth = make(map[string]*AWSAuth)
+	}
+	ag.AWSAuth[cluster] = awsauth
+	return nil
+}
+
+// parseAWSAuth parses the YAML-encoded mapRoles, mapUsers and mapAccounts
+// entries of the aws-auth config map.
+func parseAWSAuth(cm *ConfigMap) (*AWSAuth, error) {
+	awsauth := &AWSAuth{}
+	if v, ok := cm.Data["mapRoles"]; ok {
+		err := yaml.Unmarshal([]byte(v), &awsauth.MapRoles)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse mapRoles: %v", err)
+		}
+	}
+	if v, ok := cm.Data["mapUsers"]; ok {
+		err := yaml.Unmarshal([]byte(v), &awsauth.MapUsers)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse mapUsers: %v", err)
+		}
+	}
+	if v, ok := cm.Data["mapAccounts"]; ok {
+		err := yaml.Unmarshal([]byte(v), &awsauth.MapAccounts)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse mapAccounts: %v", err)
+		}
+	}
+	return awsauth, nil
+}
+
+// roleMappings returns the aws-auth mappings of the IAM role with the given
+// ARN, one per cluster that maps the role. Note that the ARNs in aws-auth
+// must not contain the path of the role, so we compare account and role
+// name only.
+func (ag *AccessGraph) roleMappings(rolearn string) []RoleMapping {
+	res := []RoleMapping{}
+	for _, cluster := range ag.clusters() {
+		awsauth, ok := ag.AWSAuth[cluster]
+		if !ok {
+			continue
+		}
+		for _, rm := range awsauth.MapRoles {
+			if sameIdentity(rm.RoleARN, rolearn) {
+				rm.Cluster = cluster
+				res = append(res, rm)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// userMappings returns the aws-auth mappings of the IAM user with the given
+// ARN, one per cluster that maps the user, taking mapped accounts into account.
+func (ag *AccessGraph) userMappings(userarn string) []UserMapping {
+	res := []UserMapping{}
+	for _, cluster := range ag.clusters() {
+		awsauth, ok := ag.AWSAuth[cluster]
+		if !ok {
+			continue
+		}
+		if um, ok := awsauth.userMapping(userarn); ok {
+			um.Cluster = cluster
+			res = append(res, um)
+		}
+	}
+	return res
+}
+
+// userMapping returns the mapping of the IAM user with the given ARN, if any.
+func (awsauth *AWSAuth) userMapping(userarn string) (UserMapping, bool) {
+	for _, um := range awsauth.MapUsers {
+		if sameIdentity(um.UserARN, userarn) {
+			return um, true
+		}
+	}
+	for _, account := range awsauth.MapAccounts {
+		if arnAccount(userarn) == account {
+			return UserMapping{UserARN: userarn, Username: userarn}, true
+		}
+	}
+	return UserMapping{}, false
+}
+
+// sameIdentity checks if two IAM ARNs refer to the same identity, ignoring
+// the path, for example arn:aws:iam::123456789012:role/some/path/eks-admin
+// and arn:aws:iam::123456789012:role/eks-admin are considered the same.
+func sameIdentity(arn1, arn2 string) bool {
+	strip := func(arn string) string {
+		resource := strings.SplitN(arn, ":", 6)
+		if len(resource) != 6 {
+			return arn
+		}
+		elements := strings.Split(resource[5], "/")
+		if len(elements) > 1 {
+			resource[5] = elements[0] + "/" + elements[len(elements)-1]
+		}
+		return strings.Join(resource, ":")
+	}
+	return strip(arn1) == strip(arn2)
+}
+
+// arnAccount returns the AWS account ID part of an ARN.
+func arnAccount(arn string) string {
+	elements := strings.SplitN(arn, ":", 6)
+	if len(elements) != 6 {
+		return ""
+	}
+	return elements[4]
+}
+
+// formatMapping provides a textual rendering of the Kubernetes user name
+// and groups an IAM identity is mapped to.
+func formatMapping(username string, groups []string) string {
+	return fmt.Sprintf("user %v in groups %v", username, strings.Join(groups, ", "))
+}
+
+// formatRoleMappings provides a textual rendering of the aws-auth mappings
+// of an IAM role, listing the cluster for each if there are several.
+func formatRoleMappings(rms []RoleMapping) string {
+	if len(rms) == 0 {
+		return "n/a"
+	}
+	if len(rms) == 1 && rms[0].Cluster == "" {
+		return formatMapping(rms[0].Username, rms[0].Groups)
+	}
+	var b strings.Builder
+	for _, rm := range rms {
+		b.WriteString(fmt.Sprintf("\n      %v: %v", rm.Cluster, formatMapping(rm.Username, rm.Groups)))
+	}
+	return b.String()
+}
+
+// formatUserMappings provides a textual rendering of the aws-auth mappings
+// of an IAM user, listing the cluster for each if there are several.
+func formatUserMappings(ums []UserMapping) string {
+	if len(ums) == 0 {
+		return "n/a"
+	}
+	if len(ums) == 1 && ums[0].Cluster == "" {
+		return formatMapping(ums[0].Username, ums[0].Groups)
+	}
+	var b strings.Builder
+	for _, um := range ums {
+		b.WriteString(fmt.Sprintf("\n      %v: %v", um.Cluster, formatMapping(um.Username, um.Groups)))
+	}
+	return b.String()
+}
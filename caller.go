@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+)
+
+// Kinds of callers, derived from the ARN STS reports for the caller.
+const (
+	callerUser          = "IAM user"
+	callerAssumedRole   = "assumed role"
+	callerFederatedUser = "federated user"
+	callerRoot          = "root"
+)
+
+// ssoRolePath is the path of the IAM roles AWS SSO provisions into accounts.
+const ssoRolePath = "/aws-reserved/sso.amazonaws.com/"
+
+// callerKind determines the kind of caller from its ARN along with its name,
+// that is, the user or role name, and for assumed roles the session name,
+// for example arn:aws:sts::123456789012:assumed-role/admin/alice yields
+// assumed role, admin and alice.
+func callerKind(callerarn string) (kind, name, session string) {
+	elements := strings.SplitN(callerarn, ":", 6)
+	if len(elements) != 6 {
+		return "", "", ""
+	}
+	resource := strings.Split(elements[5], "/")
+	switch resource[0] {
+	case "user":
+		return callerUser, resource[len(resource)-1], ""
+	case "assumed-role":
+		if len(resource) < 3 {
+			return callerAssumedRole, resource[len(resource)-1], ""
+		}
+		return callerAssumedRole, resource[1], resource[2]
+	case "federated-user":
+		return callerFederatedUser, resource[len(resource)-1], ""
+	case "root":
+		return callerRoot, "", ""
+	}
+	return "", "", ""
+}
+
+// callerRoleARN returns the ARN of the IAM role the caller assumed, if any.
+// STS doesn't tell us the path of the role, so we look up the role in the
+// access graph and fall back to an ARN without path if it's not there.
+func (ag *AccessGraph) callerRoleARN() (string, bool) {
+	if ag.Caller == nil || ag.Caller.Arn == nil {
+		return "", false
+	}
+	kind, name, _ := callerKind(*ag.Caller.Arn)
+	if kind != callerAssumedRole {
+		return "", false
+	}
+	account := arnAccount(*ag.Caller.Arn)
+	for rolearn, role := range ag.Roles {
+		if *role.RoleName == name && arnAccount(rolearn) == account {
+			return rolearn, true
+		}
+	}
+	return "arn:aws:iam::" + account + ":role/" + name, true
+}
+
+// isSSORole checks if the role with the given ARN has been provisioned by
+// AWS SSO, based on its path or, if we don't know the role, its name.
+func (ag *AccessGraph) isSSORole(rolearn string) bool {
+	if role, ok := ag.Roles[rolearn]; ok && role.Path != nil {
+		return strings.HasPrefix(*role.Path, ssoRolePath)
+	}
+	return strings.Contains(rolearn, ":role/AWSReservedSSO_")
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Exit codes of the non-interactive mode.
+const (
+	// exitOK signals that the command completed successfully.
+	exitOK = 0
+	// exitError signals a generic error, for example failing to write a file.
+	exitError = 1
+	// exitCollection signals that the access graph couldn't be set up.
+	exitCollection = 2
+	// exitUsage signals an unknown command or invalid arguments.
+	exitUsage = 3
+	// exitNotFound signals that the requested item doesn't exist.
+	exitNotFound = 4
+)
+
+// itemKinds maps the item kinds used on the command line to the item
+// types used in the history and in traces.
+var itemKinds = map[string]string{
+	"role":            "IAM role",
+	"policy":          "IAM policy",
+	"sa":              "Kubernetes service account",
+	"secret":          "Kubernetes secret",
+	"pod":             "Kubernetes pod",
+	"k8s-role":        "Kubernetes role",
+	"k8s-clusterrole": "Kubernetes cluster role",
+	"binding":         "Kubernetes role binding",
+	"clusterbinding":  "Kubernetes cluster role binding",
+}
+
+// itemKind looks up the item type of the item kind used on the command
+// line, which may also be plural, for example roles or policies.
+func itemKind(kind string) (string, bool) {
+	if itype, ok := itemKinds[kind]; ok {
+		return itype, true
+	}
+	switch {
+	case strings.HasSuffix(kind, "ies"):
+		kind = strings.TrimSuffix(kind, "ies") + "y"
+	case strings.HasSuffix(kind, "s"):
+		kind = strings.TrimSuffix(kind, "s")
+	default:
+		return "", false
+	}
+	itype, ok := itemKinds[kind]
+	return itype, ok
+}
+
+// runCLI executes a single command in non-interactive mode, with args being
+// the command line arguments without the program name, and returns the exit
+// code. Results go to stdout, everything else goes to stderr, so that the
+// output can be piped into other tools.
+func runCLI(args []string) int {
+	args, of, err := extractOutputFormat(args, outputformat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n%v", err, cliUsage())
+		return exitUsage
+	}
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cliUsage())
+		return exitUsage
+	}
+	switch args[0] {
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage())
+		return exitOK
+	case "version", "--version":
+		fmt.Println(Version)
+		return exitOK
+	case "diff":
+		return cliDiff(of, args[1:])
+	case "keygen":
+		return cliKeygen(args[1:])
+	case "snapshots":
+		return cliSnapshots(of, args[1:])
+	case "get", "dump", "export", "status", "reveal":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%v", args[0], cliUsage())
+		return exitUsage
+	}
+	ag, err = initAccessGraph()
+	// the report tells what's missing, unless loading a dump failed:
+	if args[0] == "status" && report != nil {
+		return cliStatus(of)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't set up access graph: %v\n", err)
+		return exitCollection
+	}
+	switch args[0] {
+	case "get":
+		return cliGet(ag, of, args[1:])
+	case "dump":
+		return cliDump(ag, args[1:])
+	case "reveal":
+		return cliReveal(ag, args[1:])
+	case "status":
+		return cliStatus(of)
+	default:
+		return cliExport(ag, args[1:])
+	}
+}
+
+// cliDiff handles 'diff DUMP [DUMP]', comparing two dumps or, with only
+// one dump given, the dump with the current access graph, and rendering
+// the differences in the output format of.
+func cliDiff(of OutputFormat, args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintf(os.Stderr, "Usage: rbiam diff DUMP [DUMP]\n\n%v", cliUsage())
+		return exitUsage
+	}
+	from, err := load(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't load %v: %v\n", args[0], err)
+		return exitError
+	}
+	to, toname := ag, "current access graph"
+	if len(args) == 2 {
+		toname = args[1]
+		to, err = load(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't load %v: %v\n", args[1], err)
+			return exitError
+		}
+	} else {
+		to, err = initAccessGraph()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't set up access graph: %v\n", err)
+			return exitCollection
+		}
+	}
+	d := diffGraphs(from, to, args[0], toname)
+	if of == OutputText {
+		fmt.Print(formatDiff(d))
+		return exitOK
+	}
+	res, err := render(of, d)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't render diff: %v\n", err)
+		return exitError
+	}
+	fmt.Print(res)
+	return exitOK
+}
+
+// cliKeygen handles 'keygen', printing a new key pair for encrypting dumps
+// in the format of key files.
+func cliKeygen(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: rbiam keygen\n\n%v", cliUsage())
+		return exitUsage
+	}
+	key, err := generateKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't generate key: %v\n", err)
+		return exitError
+	}
+	fmt.Print(key)
+	return exitOK
+}
+
+// cliSnapshots handles 'snapshots [DIR]', listing the dumps in DIR, or the
+// snapshot directory, in the output format of.
+func cliSnapshots(of OutputFormat, args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintf(os.Stderr, "Usage: rbiam snapshots [DIR]\n\n%v", cliUsage())
+		return exitUsage
+	}
+	dir := snapshotDir()
+	if len(args) == 1 {
+		dir = args[0]
+	}
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't list snapshots: %v\n", err)
+		return exitError
+	}
+	if of == OutputText {
+		fmt.Print(formatSnapshots(dir, snapshots))
+		return exitOK
+	}
+	res, err := render(of, snapshots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't render snapshots: %v\n", err)
+		return exitError
+	}
+	fmt.Print(res)
+	return exitOK
+}
+
+// cliStatus handles 'status', rendering the report of the collection in the
+// output format of. The exit code signals if required info is missing.
+func cliStatus(of OutputFormat) int {
+	if report == nil {
+		fmt.Println("The access graph has been loaded from a local dump, there is no collection report.")
+		return exitOK
+	}
+	res := formatReport(report)
+	if of != OutputText {
+		var err error
+		res, err = render(of, report)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't render status: %v\n", err)
+			return exitError
+		}
+	}
+	fmt.Print(res)
+	if report.err() != nil {
+		return exitCollection
+	}
+	return exitOK
+}
+
+// cliGet handles 'get KIND [KEY]', for example 'get pod default:s3-echoer',
+// rendering the result in the output format of. Without KEY, all items of
+// the kind are listed, for example 'get roles -o json'.
+func cliGet(ag *AccessGraph, of OutputFormat, args []string) int {
+	if len(args) == 1 && args[0] == "user" {
+		if ag.Caller == nil {
+			fmt.Fprintln(os.Stderr, "No info about the calling AWS identity available")
+			return exitNotFound
+		}
+		if of == OutputText {
+			fmt.Print(formatCaller(ag))
+			return exitOK
+		}
+		res, err := render(of, callerView(ag))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't render caller: %v\n", err)
+			return exitError
+		}
+		fmt.Print(res)
+		return exitOK
+	}
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: rbiam get KIND [KEY]\n\n%v", cliUsage())
+		return exitUsage
+	}
+	itype, ok := itemKind(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown kind %q\n\n%v", args[0], cliUsage())
+		return exitUsage
+	}
+	if len(args) == 1 {
+		res, err := renderItems(ag, of, itype)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't render %v items: %v\n", itype, err)
+			return exitError
+		}
+		fmt.Print(res)
+		return exitOK
+	}
+	res, ok, err := renderItem(ag, of, itype, args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't render %v %v: %v\n", itype, args[1], err)
+		return exitError
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "No %v %v found\n", itype, args[1])
+		return exitNotFound
+	}
+	fmt.Print(res)
+	return exitOK
+}
+
+// cliDump handles 'dump [--include-secrets] [--name NAME]', with the payload
+// of secrets stripped unless asked for.
+func cliDump(ag *AccessGraph, args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	includesecrets := fs.Bool("include-secrets", false, "include the payload of secrets")
+	name := fs.String("name", "", "name of the snapshot")
+	err := fs.Parse(args)
+	if err != nil || fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: rbiam dump [--include-secrets] [--name NAME]\n\n%v", cliUsage())
+		return exitUsage
+	}
+	if err := validateSnapshotName(*name); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitUsage
+	}
+	fn, err := dump(ag, *includesecrets, *name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't export access graph: %v\n", err)
+		return exitError
+	}
+	fmt.Println(fn)
+	return exitOK
+}
+
+// cliReveal handles 'reveal SECRET KEY', printing the value of a single
+// key of a secret.
+func cliReveal(ag *AccessGraph, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: rbiam reveal SECRET KEY\n\n%v", cliUsage())
+		return exitUsage
+	}
+	if _, ok := ag.Secrets[args[0]]; !ok {
+		fmt.Fprintf(os.Stderr, "No %v %v found\n", "Kubernetes secret", args[0])
+		return exitNotFound
+	}
+	v, err := revealSecret(ag, args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't reveal secret: %v\n", err)
+		return exitError
+	}
+	fmt.Println(v)
+	return exitOK
+}
+
+// cliExport handles 'export raw|graph --items KIND=KEY,...', for example
+// 'export graph --items pod=default:s3-echoer,sa=default:s3-echoer'.
+func cliExport(ag *AccessGraph, args []string) int {
+	if len(args) < 1 || (args[0] != "raw" && args[0] != "graph") {
+		fmt.Fprintf(os.Stderr, "Usage: rbiam export raw|graph --items KIND=KEY,... [--include-secrets]\n\n%v", cliUsage())
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	items := fs.String("items", "", "comma-separated list of items to export in the form KIND=KEY")
+	includesecrets := fs.Bool("include-secrets", false, "include the payload of secrets in raw exports")
+	err := fs.Parse(args[1:])
+	if err != nil || *items == "" {
+		fmt.Fprintf(os.Stderr, "Usage: rbiam export raw|graph --items KIND=KEY,... [--include-secrets]\n\n%v", cliUsage())
+		return exitUsage
+	}
+	trace := []string{}
+	for _, item := range strings.Split(*items, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			fmt.Fprintf(os.Stderr, "Invalid item %q, expected KIND=KEY\n", item)
+			return exitUsage
+		}
+		itype, ok := itemKinds[kv[0]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown kind %q\n\n%v", kv[0], cliUsage())
+			return exitUsage
+		}
+		if _, ok := describe(ag, itype, kv[1]); !ok {
+			fmt.Fprintf(os.Stderr, "No %v %v found\n", itype, kv[1])
+			return exitNotFound
+		}
+		trace = append(trace, histitem(itype, kv[1]))
+	}
+	var fn string
+	if args[0] == "graph" {
+		fn, err = exportGraph(trace, ag)
+	} else {
+		fn, err = exportRaw(trace, ag, *includesecrets)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't export trace: %v\n", err)
+		return exitError
+	}
+	fmt.Println(fn)
+	return exitOK
+}
+
+// describe provides the textual rendering of the item of type itype with
+// the key ikey, using the same item types as the history, and reports if
+// the item exists in the access graph.
+func describe(ag *AccessGraph, itype, ikey string) (string, bool) {
+	switch itype {
+	case "IAM role":
+		if role, ok := ag.Roles[ikey]; ok {
+			return formatRole(ag, &role), true
+		}
+	case "IAM policy":
+		if policy, ok := ag.Policies[ikey]; ok {
+			pd := ag.PolicyDocuments[ikey]
+			return formatPolicy(&policy, ag.PolicyAttachments[ikey], &pd, ag.PolicyDocumentErrors[ikey]), true
+		}
+	case "Kubernetes service account":
+		if sa, ok := ag.ServiceAccounts[ikey]; ok {
+			return formatSA(ag, &sa), true
+		}
+	case "Kubernetes secret":
+		if secret, ok := ag.Secrets[ikey]; ok {
+			return formatSecret(&secret), true
+		}
+	case "Kubernetes pod":
+		if pod, ok := ag.Pods[ikey]; ok {
+			return formatPod(ag, &pod), true
+		}
+	case "Kubernetes role":
+		if role, ok := ag.KubeRoles[ikey]; ok {
+			return formatKubeRole(&role), true
+		}
+	case "Kubernetes cluster role":
+		if crole, ok := ag.KubeClusterRoles[ikey]; ok {
+			return formatClusterRole(&crole), true
+		}
+	case "Kubernetes role binding":
+		if rb, ok := ag.KubeRoleBindings[ikey]; ok {
+			return formatRoleBinding(&rb), true
+		}
+	case "Kubernetes cluster role binding":
+		if crb, ok := ag.KubeClusterRoleBindings[ikey]; ok {
+			return formatClusterRoleBinding(&crb), true
+		}
+	}
+	return "", false
+}
+
+// cliUsage provides the usage instructions for the non-interactive mode.
+func cliUsage() string {
+	return "Usage: rbiam [COMMAND]\n\n" +
+		"Without a command, rbiam starts an interactive session. Commands:\n" +
+		"  get user                       describe the calling AWS identity, an IAM user or an assumed role\n" +
+		"  get KIND KEY                   describe the item of kind KIND with key KEY\n" +
+		"  get KIND                       list all items of kind KIND, with their details unless in text output format\n" +
+		"  dump [--include-secrets] [--name NAME]\n" +
+		"                                 export access graph as a JSON dump in the snapshot directory, optionally\n" +
+		"                                 as named snapshot, without the payload of secrets unless --include-secrets is given\n" +
+		"  diff DUMP [DUMP]               show the differences between two dumps, or a dump and the current access graph\n" +
+		"  export raw|graph --items ITEMS export items as JSON dump or DOT file in current working directory,\n" +
+		"                                 with ITEMS being a comma-separated list of KIND=KEY, use\n" +
+		"                                 --include-secrets to include the payload of secrets in raw exports\n" +
+		"  keygen                         generate a key pair for encrypting dumps, see below\n" +
+		"  snapshots [DIR]                list the dumps in DIR or the snapshot directory with their metadata\n" +
+		"  reveal SECRET KEY              show the value of the key KEY of the secret SECRET\n" +
+		"  status                         show which info could be collected from IAM and Kubernetes\n" +
+		"  version                        show the version of rbiam\n" +
+		"  help                           show this help\n\n" +
+		"Options:\n" +
+		"  -o, --output FORMAT            output format of get, status, diff and snapshots: text (default), json, yaml or table,\n" +
+		"                                 the default can be set via the RBIAM_OUTPUT environment variable\n\n" +
+		"Dumps are written to and looked up in RBIAM_SNAPSHOT_DIR, the current working directory by default.\n" +
+		"RBIAM_OFFLINE loads a dump instead of collecting from IAM and Kubernetes, set it to the path of a dump,\n" +
+		"a directory to use the latest dump in it, or the name of a snapshot to use the latest one with this name.\n" +
+		"In this offline mode, neither AWS nor Kubernetes config is needed. RBIAM_OFFLINE=false turns it off.\n\n" +
+		"Dumps are encrypted if RBIAM_DUMP_PASSPHRASE or RBIAM_DUMP_RECIPIENTS, a comma-separated list of\n" +
+		"public keys, is set. Encrypted dumps are decrypted with RBIAM_DUMP_PASSPHRASE or the private keys\n" +
+		"in the key file RBIAM_DUMP_IDENTITY, for example: rbiam keygen > key.txt\n\n" +
+		"Supported KINDs: role, policy, sa, secret, pod, k8s-role, k8s-clusterrole, binding, clusterbinding,\n" +
+		"or their plural, for example roles or policies\n\n" +
+		"Exit codes: 0 success, 1 error, 2 can't set up access graph, 3 usage error, 4 item not found\n"
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// withoutAWSConfig makes loading the AWS config fail the test, for the
+// duration of the test.
+func withoutAWSConfig(t *testing.T) {
+	orig := loadAWSConfig
+	loadAWSConfig = func() (aws.Config, error) {
+		t.Errorf("loaded AWS config")
+		return aws.Config{}, fmt.Errorf("no AWS config in tests")
+	}
+	t.Cleanup(func() { loadAWSConfig = orig })
+}
+
+func TestCLIWithoutAWSConfig(t *testing.T) {
+	withoutAWSConfig(t)
+	dir := t.TempDir()
+	t.Setenv("RBIAM_SNAPSHOT_DIR", dir)
+	b, err := marshalDump(fixtureGraph(t), false, &SnapshotInfo{})
+	if err != nil {
+		t.Fatalf("can't marshal dump: %v", err)
+	}
+	dumps := []string{filepath.Join(dir, "rbiam-dump-1564315687.json"), filepath.Join(dir, "rbiam-dump-1564315688.json")}
+	for _, fn := range dumps {
+		err = ioutil.WriteFile(fn, b, 0600)
+		if err != nil {
+			t.Fatalf("can't write dump: %v", err)
+		}
+	}
+	for _, args := range [][]string{
+		{"keygen"},
+		{"snapshots"},
+		{"diff", dumps[0], dumps[1]},
+	} {
+		if code := runCLI(args); code != exitOK {
+			t.Errorf("got exit code %v for %v, want %v", code, args, exitOK)
+		}
+	}
+}
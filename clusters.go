@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// eksEndpoint matches the API server endpoint of EKS clusters, capturing
+// the cluster ID, which is the same ID the OIDC issuer of the cluster uses.
+var eksEndpoint = regexp.MustCompile(`^https://([0-9A-Fa-f]+)\.[a-z0-9]+\.[a-z0-9-]+\.eks\.amazonaws\.com`)
+
+// eksClusterARN matches the ARN of an EKS cluster, capturing the account ID.
+var eksClusterARN = regexp.MustCompile(`^arn:aws[a-z-]*:eks:[a-z0-9-]+:([0-9]{12}):cluster/`)
+
+// kubeSources sets up the Kubernetes sources to collect from, keyed by the
+// cluster name used in the access graph. By default that's the current
+// context (or the one set via RBIAM_KUBE_CONTEXT) with an empty cluster
+// name, so keys look like before. With the RBIAM_KUBE_CONTEXTS environment
+// variable one can select several clusters, with the context name serving
+// as cluster name:
+//
+//	RBIAM_KUBE_CONTEXTS=ctx1,ctx2   the listed contexts of the kubeconfig
+//	RBIAM_KUBE_CONTEXTS=all         all contexts of the kubeconfig
+//	RBIAM_KUBE_CONTEXTS=eks         all EKS clusters of the AWS account and region
+func kubeSources(cfg aws.Config) map[string]KubeSource {
+	selection := os.Getenv("RBIAM_KUBE_CONTEXTS")
+	switch selection {
+	case "":
+		return map[string]KubeSource{"": newKubeAPISource(os.Getenv("RBIAM_KUBE_CONTEXT"))}
+	case "eks":
+		return eksSources(cfg)
+	}
+	contexts := []string{}
+	if selection == "all" {
+		kubeconfig, err := loadKubeconfig()
+		if err != nil {
+			return map[string]KubeSource{"": &kubeAPISource{err: err}}
+		}
+		if kubeconfig == nil {
+			return map[string]KubeSource{"": &kubeAPISource{err: fmt.Errorf("no kubeconfig found")}}
+		}
+		for _, kctx := range kubeconfig.Contexts {
+			contexts = append(contexts, kctx.Name)
+		}
+	} else {
+		contexts = splitList(selection)
+	}
+	srcs := make(map[string]KubeSource)
+	for _, kctx := range contexts {
+		srcs[kctx] = newKubeAPISource(kctx)
+	}
+	return srcs
+}
+
+// eksSources sets up a Kubernetes source for each EKS cluster in the
+// account and region of the AWS config cfg, authenticating with a token
+// derived from the AWS credentials, like 'aws eks get-token' does.
+func eksSources(cfg aws.Config) map[string]KubeSource {
+	timeout, err := kubeTimeout()
+	if err != nil {
+		return map[string]KubeSource{"": &kubeAPISource{err: err}}
+	}
+	svc := eks.New(cfg)
+	names := []string{}
+	var token *string
+	for {
+		req := svc.ListClustersRequest(&eks.ListClustersInput{NextToken: token})
+		res, err := req.Send(context.TODO())
+		if err != nil {
+			return map[string]KubeSource{"": &kubeAPISource{err: fmt.Errorf("can't list EKS clusters: %v", err)}}
+		}
+		names = append(names, res.Clusters...)
+		if res.NextToken == nil {
+			break
+		}
+		token = res.NextToken
+	}
+	srcs := make(map[string]KubeSource)
+	for _, name := range names {
+		srcs[name] = newEKSSource(cfg, name, timeout)
+	}
+	return srcs
+}
+
+// newEKSSource sets up a Kubernetes source for the EKS cluster with the
+// given name, using its endpoint and certificate authority as reported by
+// the EKS API.
+func newEKSSource(cfg aws.Config, name string, timeout time.Duration) *kubeAPISource {
+	svc := eks.New(cfg)
+	req := svc.DescribeClusterRequest(&eks.DescribeClusterInput{Name: aws.String(name)})
+	res, err := req.Send(context.TODO())
+	if err != nil {
+		return &kubeAPISource{err: fmt.Errorf("can't describe EKS cluster %v: %v", name, err)}
+	}
+	cluster := res.Cluster
+	if cluster.Endpoint == nil {
+		return &kubeAPISource{err: fmt.Errorf("EKS cluster %v has no endpoint (status %v)", name, cluster.Status)}
+	}
+	kubecluster := NamedCluster{
+		Name:    aws.StringValue(cluster.Arn),
+		Cluster: Cluster{Server: *cluster.Endpoint},
+	}
+	if cluster.CertificateAuthority != nil && cluster.CertificateAuthority.Data != nil {
+		ca, err := base64.StdEncoding.DecodeString(*cluster.CertificateAuthority.Data)
+		if err != nil {
+			return &kubeAPISource{err: fmt.Errorf("invalid certificate authority of EKS cluster %v: %v", name, err)}
+		}
+		kubecluster.Cluster.CertificateAuthorityData = ca
+	}
+	token, err := eksToken(cfg, name)
+	if err != nil {
+		return &kubeAPISource{err: fmt.Errorf("can't get token for EKS cluster %v: %v", name, err)}
+	}
+	kubeconfig := &Config{
+		Clusters:       []NamedCluster{kubecluster},
+		AuthInfos:      []NamedAuthInfo{{Name: name, AuthInfo: AuthInfo{Token: token}}},
+		Contexts:       []NamedContext{{Name: name, Context: Context{Cluster: kubecluster.Name, AuthInfo: name}}},
+		CurrentContext: name,
+	}
+	src, err := kubeconfigSource(kubeconfig, name, timeout)
+	if err != nil {
+		return &kubeAPISource{err: err}
+	}
+	return src
+}
+
+// eksToken creates a bearer token for the EKS cluster with the given name,
+// which is a presigned STS GetCallerIdentity request, see also:
+// https://github.com/kubernetes-sigs/aws-iam-authenticator#api-authorization-from-outside-a-cluster
+func eksToken(cfg aws.Config, name string) (string, error) {
+	svc := sts.New(cfg)
+	req := svc.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	req.HTTPRequest.Header.Add("x-k8s-aws-id", name)
+	presigned, err := req.Presign(60 * time.Second)
+	if err != nil {
+		return "", err
+	}
+	return "k8s-aws-v1." + base64.RawURLEncoding.EncodeToString([]byte(presigned)), nil
+}
+
+// clusters returns the names of the clusters in the access graph, which is
+// a single, empty name unless several clusters have been selected.
+func (ag *AccessGraph) clusters() []string {
+	if len(ag.KubeContexts) == 0 {
+		return []string{""}
+	}
+	return ag.KubeContexts
+}
+
+// kubeCluster returns the kubeconfig cluster of the cluster with the given
+// name in the access graph, or nil if the kubeconfig doesn't have it.
+func (ag *AccessGraph) kubeCluster(cluster string) *NamedCluster {
+	if ag.KubeConfig == nil {
+		return nil
+	}
+	kctx := ag.KubeConfig.CurrentContext
+	if cluster != "" {
+		kctx = cluster
+	}
+	for _, c := range ag.KubeConfig.Contexts {
+		if c.Name != kctx {
+			continue
+		}
+		for i, kc := range ag.KubeConfig.Clusters {
+			if kc.Name == c.Context.Cluster {
+				return &ag.KubeConfig.Clusters[i]
+			}
+		}
+	}
+	return nil
+}
+
+// eksClusterID returns the ID of the EKS cluster with the given name in
+// the access graph, or an empty string if it's not an EKS cluster.
+func (ag *AccessGraph) eksClusterID(cluster string) string {
+	kc := ag.kubeCluster(cluster)
+	if kc == nil {
+		return ""
+	}
+	if m := eksEndpoint.FindStringSubmatch(kc.Cluster.Server); m != nil {
+		return strings.ToUpper(m[1])
+	}
+	return ""
+}
+
+// clusterAccount returns the ID of the AWS account the cluster with the given
+// name runs in. We can tell for EKS clusters whose kubeconfig cluster or
+// context is named by the ARN of the cluster, as 'aws eks update-kubeconfig'
+// and the EKS sources do, otherwise we assume it's the caller's account.
+func (ag *AccessGraph) clusterAccount(cluster string) string {
+	names := []string{cluster}
+	if kc := ag.kubeCluster(cluster); kc != nil {
+		names = append(names, kc.Name)
+	}
+	if cluster == "" && ag.KubeConfig != nil {
+		names = append(names, ag.KubeConfig.CurrentContext)
+	}
+	for _, name := range names {
+		if m := eksClusterARN.FindStringSubmatch(name); m != nil {
+			return m[1]
+		}
+	}
+	if ag.Caller != nil && ag.Caller.Account != nil {
+		return *ag.Caller.Account
+	}
+	return ""
+}
+
+// trustsCluster checks if the OIDC provider with the given ARN can issue
+// tokens for the cluster. For EKS clusters we compare the cluster ID with
+// the one of the provider, for example oidc.eks.REGION.amazonaws.com/id/ID,
+// otherwise we can't tell and assume it does.
+func (ag *AccessGraph) trustsCluster(provider, cluster string) bool {
+	id := ag.eksClusterID(cluster)
+	i := strings.LastIndex(provider, "/id/")
+	if id == "" || !strings.Contains(provider, "oidc.eks.") || i < 0 {
+		return true
+	}
+	return strings.ToUpper(provider[i+len("/id/"):]) == id
+}
+
+// sortedSources returns the cluster names of the Kubernetes sources in
+// alphabetical order, for a stable collection order.
+func sortedSources(srcs map[string]KubeSource) []string {
+	names := []string{}
+	for name := range srcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
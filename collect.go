@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// defaultParallelism is the maximum number of concurrent requests against
+// the IAM and Kubernetes sources, unless overwritten by the
+// RBIAM_PARALLELISM environment variable.
+const defaultParallelism = 8
+
+// awsMaxRetries is how often AWS requests are retried, for example when
+// IAM throttles us. The SDK backs off exponentially between attempts and
+// honours the retry delay the service asks for.
+const awsMaxRetries = 10
+
+// collectionParallelism returns the maximum number of concurrent requests
+// against the sources, as set via RBIAM_PARALLELISM, falling back to the
+// default for invalid values.
+func collectionParallelism() int {
+	v := os.Getenv("RBIAM_PARALLELISM")
+	if v == "" {
+		return defaultParallelism
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid RBIAM_PARALLELISM %q, using %v\n", v, defaultParallelism)
+		return defaultParallelism
+	}
+	return n
+}
+
+// withRetries returns a copy of the AWS config cfg that retries requests
+// with exponential backoff, since running many requests concurrently makes
+// throttling by IAM and EC2 a lot more likely.
+func withRetries(cfg aws.Config) aws.Config {
+	cfg = cfg.Copy()
+	cfg.Retryer = aws.DefaultRetryer{NumMaxRetries: awsMaxRetries}
+	return cfg
+}
+
+// limiter bounds the number of concurrent calls, with its capacity being
+// the maximum.
+type limiter chan struct{}
+
+// do calls fn as soon as there is capacity.
+func (l limiter) do(fn func()) {
+	l <- struct{}{}
+	defer func() { <-l }()
+	fn()
+}
+
+// limitSources wraps the IAM and Kubernetes sources so that all of them
+// together issue at most n concurrent requests.
+func limitSources(iamsrcs map[string]IAMSource, kubesrcs map[string]KubeSource, n int) (map[string]IAMSource, map[string]KubeSource) {
+	l := make(limiter, n)
+	for via, src := range iamsrcs {
+		iamsrcs[via] = limitedIAMSource{src: src, limit: l}
+	}
+	for cluster, src := range kubesrcs {
+		kubesrcs[cluster] = limitedKubeSource{src: src, limit: l}
+	}
+	return iamsrcs, kubesrcs
+}
+
+// concurrently calls all of fns in parallel and waits for them to return.
+func concurrently(fns ...func()) {
+	var wg sync.WaitGroup
+	for _, fn := range fns {
+		wg.Add(1)
+		go func(fn func()) {
+			defer wg.Done()
+			fn()
+		}(fn)
+	}
+	wg.Wait()
+}
+
+// parallel calls fn for 0 to n-1 in parallel and waits for all calls to
+// return. If any of the calls fail, it returns the error of the first one,
+// in the order of i.
+func parallel(n int, fn func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitedIAMSource is an IAM source with a bound on concurrent requests,
+// shared with other sources via limit.
+type limitedIAMSource struct {
+	src   IAMSource
+	limit limiter
+}
+
+// CallerIdentity returns the identity of the caller.
+func (s limitedIAMSource) CallerIdentity() (res *sts.GetCallerIdentityOutput, err error) {
+	s.limit.do(func() { res, err = s.src.CallerIdentity() })
+	return res, err
+}
+
+// User returns the IAM user issuing the requests.
+func (s limitedIAMSource) User() (res *iam.User, err error) {
+	s.limit.do(func() { res, err = s.src.User() })
+	return res, err
+}
+
+// Roles returns all IAM roles.
+func (s limitedIAMSource) Roles() (res []iam.Role, err error) {
+	s.limit.do(func() { res, err = s.src.Roles() })
+	return res, err
+}
+
+// RolePolicies returns the managed and inline policies of the role.
+func (s limitedIAMSource) RolePolicies(role iam.Role) (res RolePolicies, err error) {
+	s.limit.do(func() { res, err = s.src.RolePolicies(role) })
+	return res, err
+}
+
+// Policies returns all attached IAM policies.
+func (s limitedIAMSource) Policies() (res []iam.Policy, err error) {
+	s.limit.do(func() { res, err = s.src.Policies() })
+	return res, err
+}
+
+// PolicyDocument returns the document of the default version of the policy.
+func (s limitedIAMSource) PolicyDocument(policy iam.Policy) (res *PolicyDocument, err error) {
+	s.limit.do(func() { res, err = s.src.PolicyDocument(policy) })
+	return res, err
+}
+
+// InstanceProfiles returns all IAM instance profiles.
+func (s limitedIAMSource) InstanceProfiles() (res []iam.InstanceProfile, err error) {
+	s.limit.do(func() { res, err = s.src.InstanceProfiles() })
+	return res, err
+}
+
+// Instances returns all EC2 instances.
+func (s limitedIAMSource) Instances() (res []ec2.Instance, err error) {
+	s.limit.do(func() { res, err = s.src.Instances() })
+	return res, err
+}
+
+// limitedKubeSource is a Kubernetes source with a bound on concurrent
+// requests, shared with other sources via limit.
+type limitedKubeSource struct {
+	src   KubeSource
+	limit limiter
+}
+
+// Config returns the Kubernetes client configuration.
+func (s limitedKubeSource) Config() (res *Config, err error) {
+	s.limit.do(func() { res, err = s.src.Config() })
+	return res, err
+}
+
+// ServiceAccounts returns the service accounts in all namespaces.
+func (s limitedKubeSource) ServiceAccounts() (res []ServiceAccount, err error) {
+	s.limit.do(func() { res, err = s.src.ServiceAccounts() })
+	return res, err
+}
+
+// Secrets returns the secrets in all namespaces.
+func (s limitedKubeSource) Secrets() (res []Secret, err error) {
+	s.limit.do(func() { res, err = s.src.Secrets() })
+	return res, err
+}
+
+// Pods returns the pods in all namespaces.
+func (s limitedKubeSource) Pods() (res []Pod, err error) {
+	s.limit.do(func() { res, err = s.src.Pods() })
+	return res, err
+}
+
+// Roles returns the roles in all namespaces.
+func (s limitedKubeSource) Roles() (res []Role, err error) {
+	s.limit.do(func() { res, err = s.src.Roles() })
+	return res, err
+}
+
+// ClusterRoles returns the cluster roles.
+func (s limitedKubeSource) ClusterRoles() (res []ClusterRole, err error) {
+	s.limit.do(func() { res, err = s.src.ClusterRoles() })
+	return res, err
+}
+
+// RoleBindings returns the role bindings in all namespaces.
+func (s limitedKubeSource) RoleBindings() (res []RoleBinding, err error) {
+	s.limit.do(func() { res, err = s.src.RoleBindings() })
+	return res, err
+}
+
+// ClusterRoleBindings returns the cluster role bindings.
+func (s limitedKubeSource) ClusterRoleBindings() (res []ClusterRoleBinding, err error) {
+	s.limit.do(func() { res, err = s.src.ClusterRoleBindings() })
+	return res, err
+}
+
+// ConfigMap returns the config map with the given namespace and name.
+func (s limitedKubeSource) ConfigMap(namespace, name string) (res *ConfigMap, err error) {
+	s.limit.do(func() { res, err = s.src.ConfigMap(namespace, name) })
+	return res, err
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+)
+
+// Delta captures how the entities of one kind changed between two access
+// graphs, for example after a sync.
+type Delta struct {
+	// Kind is the kind of entities, for example IAM roles.
+	Kind string `json:"kind"`
+	// Added are the keys of entities that are new.
+	Added []string `json:"added,omitempty"`
+	// Removed are the keys of entities that are gone.
+	Removed []string `json:"removed,omitempty"`
+	// Changed are the keys of entities that have been modified.
+	Changed []string `json:"changed,omitempty"`
+}
+
+// deltas compares the access graph cur with the previous one, prev, and
+// returns the changes for each kind of entity that changed. IAM roles count
+// as changed if the role itself or its attached policies changed, IAM
+// policies if their default version or update date changed and Kubernetes
+// objects if their resource version changed.
+func deltas(prev, cur *AccessGraph) []Delta {
+	prevvs, curvs := versions(prev), versions(cur)
+	ds := []Delta{}
+	for _, kind := range deltaKinds {
+		d := Delta{Kind: kind}
+		for key, v := range curvs[kind] {
+			prevv, ok := prevvs[kind][key]
+			switch {
+			case !ok:
+				d.Added = append(d.Added, key)
+			case prevv != v:
+				d.Changed = append(d.Changed, key)
+			}
+		}
+		for key := range prevvs[kind] {
+			if _, ok := curvs[kind][key]; !ok {
+				d.Removed = append(d.Removed, key)
+			}
+		}
+		if len(d.Added)+len(d.Removed)+len(d.Changed) == 0 {
+			continue
+		}
+		sort.Strings(d.Added)
+		sort.Strings(d.Removed)
+		sort.Strings(d.Changed)
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+// deltaKinds are the kinds of entities deltas() compares, in the order
+// they are reported.
+var deltaKinds = []string{
+	"IAM roles",
+	"IAM policies",
+	"Kubernetes service accounts",
+	"Kubernetes secrets",
+	"Kubernetes pods",
+	"Kubernetes roles",
+	"Kubernetes cluster roles",
+	"Kubernetes role bindings",
+	"Kubernetes cluster role bindings",
+}
+
+// versions returns, for each kind of entity, the version of each entity
+// in the access graph, keyed by the entity's key.
+func versions(ag *AccessGraph) map[string]map[string]string {
+	vs := make(map[string]map[string]string)
+	for _, kind := range deltaKinds {
+		vs[kind] = make(map[string]string)
+	}
+	for rolearn, role := range ag.Roles {
+		vs["IAM roles"][rolearn] = jsonVersion(struct {
+			Role     iam.Role
+			Policies RolePolicies
+		}{role, ag.RolePolicies[rolearn]})
+	}
+	for policyarn, policy := range ag.Policies {
+		vs["IAM policies"][policyarn] = policyVersion(policy)
+	}
+	for key, sa := range ag.ServiceAccounts {
+		vs["Kubernetes service accounts"][key] = kubeVersion(sa.ObjectMeta, sa)
+	}
+	for key, secret := range ag.Secrets {
+		// compare without payload, since dumps usually don't have it:
+		vs["Kubernetes secrets"][key] = kubeVersion(secret.ObjectMeta, stripSecret(secret))
+	}
+	for key, pod := range ag.Pods {
+		vs["Kubernetes pods"][key] = kubeVersion(pod.ObjectMeta, pod)
+	}
+	for key, role := range ag.KubeRoles {
+		vs["Kubernetes roles"][key] = kubeVersion(role.ObjectMeta, role)
+	}
+	for key, role := range ag.KubeClusterRoles {
+		vs["Kubernetes cluster roles"][key] = kubeVersion(role.ObjectMeta, role)
+	}
+	for key, binding := range ag.KubeRoleBindings {
+		vs["Kubernetes role bindings"][key] = kubeVersion(binding.ObjectMeta, binding)
+	}
+	for key, binding := range ag.KubeClusterRoleBindings {
+		vs["Kubernetes cluster role bindings"][key] = kubeVersion(binding.ObjectMeta, binding)
+	}
+	return vs
+}
+
+// policyVersion identifies the version of the policy by its default
+// version and the date it has last been updated.
+func policyVersion(policy iam.Policy) string {
+	updated := ""
+	if policy.UpdateDate != nil {
+		updated = policy.UpdateDate.UTC().Format(time.RFC3339)
+	}
+	return aws.StringValue(policy.DefaultVersionId) + " " + updated
+}
+
+// kubeVersion identifies the version of the Kubernetes object obj by its
+// resource version, falling back to the entire object for objects without,
+// for example from fixtures.
+func kubeVersion(meta ObjectMeta, obj interface{}) string {
+	if meta.ResourceVersion != "" {
+		return meta.UID + "/" + meta.ResourceVersion
+	}
+	return jsonVersion(obj)
+}
+
+// jsonVersion identifies the version of v by its JSON encoding.
+func jsonVersion(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// formatDeltas provides a textual rendering of the changes, with + marking
+// added, - removed and ~ changed entities.
+func formatDeltas(ds []Delta) string {
+	if len(ds) == 0 {
+		return "No changes since the last sync.\n"
+	}
+	var b strings.Builder
+	for _, d := range ds {
+		b.WriteString(fmt.Sprintf("     %v: %v added, %v removed, %v changed", d.Kind, len(d.Added), len(d.Removed), len(d.Changed)))
+		for _, key := range d.Added {
+			b.WriteString("\n      + " + key)
+		}
+		for _, key := range d.Removed {
+			b.WriteString("\n      - " + key)
+		}
+		for _, key := range d.Changed {
+			b.WriteString("\n      ~ " + key)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
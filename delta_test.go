@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+)
+
+// changedInline is an IAM source with an additional inline policy embedded
+// in one of the roles, which doesn't change any attachment count, and which
+// counts the policy documents fetched.
+type changedInline struct {
+	*iamFixtures
+	rolearn, inline string
+	mu              sync.Mutex
+	documents       int
+}
+
+func (src *changedInline) RolePolicies(role iam.Role) (RolePolicies, error) {
+	rp, err := src.iamFixtures.RolePolicies(role)
+	if err == nil && *role.Arn == src.rolearn {
+		rp.Inline = append(append([]string{}, rp.Inline...), src.inline)
+	}
+	return rp, err
+}
+
+func (src *changedInline) PolicyDocument(policy iam.Policy) (*PolicyDocument, error) {
+	src.mu.Lock()
+	src.documents++
+	src.mu.Unlock()
+	return src.iamFixtures.PolicyDocument(policy)
+}
+
+func TestRefreshInlinePolicyChange(t *testing.T) {
+	ag := fixtureGraph(t)
+	rolearn := "arn:aws:iam::123456789012:role/eks-node"
+	src := &changedInline{iamFixtures: newIAMFixtures(filepath.Join(fixtureDir, "iam")), rolearn: rolearn, inline: "node-debug"}
+	newag, report := ag.refresh(
+		map[string]IAMSource{"": src},
+		map[string]KubeSource{"": kubeFixtures{dir: filepath.Join(fixtureDir, "k8s")}},
+	)
+	if failed := report.failed(); len(failed) > 0 {
+		t.Fatalf("collectors failed:\n%v", formatFailures(report))
+	}
+	inline := newag.RolePolicies[rolearn].Inline
+	if len(inline) == 0 || inline[len(inline)-1] != "node-debug" {
+		t.Errorf("got inline policies %v of eks-node, want node-debug among them", inline)
+	}
+	if src.documents != 0 {
+		t.Errorf("got %v policy documents fetched, want the unchanged ones reused", src.documents)
+	}
+	var changed []string
+	for _, d := range deltas(ag, newag) {
+		if d.Kind == "IAM roles" {
+			changed = d.Changed
+		}
+	}
+	if len(changed) != 1 || changed[0] != rolearn {
+		t.Errorf("got changed roles %v, want eks-node", changed)
+	}
+}
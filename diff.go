@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Edge is a relationship between two entities of the access graph, with
+// the entities in the same '[TYPE] KEY' notation as history items.
+type Edge struct {
+	From     string `json:"from"`
+	Relation string `json:"relation"`
+	To       string `json:"to"`
+}
+
+// String provides a textual rendering of the edge.
+func (e Edge) String() string {
+	return fmt.Sprintf("%v %v %v", e.From, e.Relation, e.To)
+}
+
+// GraphDiff captures the differences between two access graphs, for
+// example two dumps taken before and after a deployment.
+type GraphDiff struct {
+	// From and To describe the old and the new access graph, for example
+	// the name of the dump.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Entities are the added, removed and changed entities per kind.
+	Entities []Delta `json:"entities"`
+	// AddedEdges and RemovedEdges are the relationships between entities
+	// that are new and gone, respectively.
+	AddedEdges   []Edge `json:"addedEdges,omitempty"`
+	RemovedEdges []Edge `json:"removedEdges,omitempty"`
+}
+
+// diffGraphs compares the old access graph from with the new one, to,
+// with fromname and toname describing them.
+func diffGraphs(from, to *AccessGraph, fromname, toname string) GraphDiff {
+	d := GraphDiff{
+		From:     fromname,
+		To:       toname,
+		Entities: deltas(from, to),
+	}
+	fromedges, toedges := from.edges(), to.edges()
+	for e := range toedges {
+		if !fromedges[e] {
+			d.AddedEdges = append(d.AddedEdges, e)
+		}
+	}
+	for e := range fromedges {
+		if !toedges[e] {
+			d.RemovedEdges = append(d.RemovedEdges, e)
+		}
+	}
+	sortEdges(d.AddedEdges)
+	sortEdges(d.RemovedEdges)
+	return d
+}
+
+// edges returns the set of relationships in the access graph:
+//
+//   - IAM roles and their managed and inline policies
+//   - principals and the IAM roles they can assume
+//   - service accounts and the IAM roles they use via IRSA
+//   - pods and their service accounts as well as their effective IAM role
+//   - service accounts and their secrets
+//   - role bindings and cluster role bindings, their roles and subjects
+//   - IAM roles and users and the Kubernetes users and groups they map to
+func (ag *AccessGraph) edges() map[Edge]bool {
+	edges := make(map[Edge]bool)
+	add := func(fromtype, from, relation, totype, to string) {
+		edges[Edge{From: histitem(fromtype, from), Relation: relation, To: histitem(totype, to)}] = true
+	}
+	for rolearn, role := range ag.Roles {
+		rp := ag.RolePolicies[rolearn]
+		for _, policy := range rp.Managed {
+			add("IAM role", rolearn, "has managed policy", "IAM policy", *policy.PolicyArn)
+		}
+		for _, name := range rp.Inline {
+			add("IAM role", rolearn, "has inline policy", "IAM inline policy", *role.RoleName+"/"+name)
+		}
+		trs, err := roleTrust(role)
+		if err != nil {
+			continue
+		}
+		for _, tr := range trs {
+			if tr.Effect != "Allow" {
+				continue
+			}
+			add(tr.PrincipalType+" principal", tr.Principal, "can assume", "IAM role", rolearn)
+		}
+	}
+	for _, link := range ag.irsaLinks() {
+		add("Kubernetes service account", link.ServiceAccount, "uses (IRSA)", "IAM role", link.Role)
+	}
+	for podkey, pod := range ag.Pods {
+		pod := pod
+		sakey := kubekey(pod.ClusterName, pod.Namespace, pod.Spec.ServiceAccountName)
+		add("Kubernetes pod", podkey, "runs as", "Kubernetes service account", sakey)
+		if rolearn, via := ag.podRole(&pod); rolearn != "" {
+			add("Kubernetes pod", podkey, "has AWS identity via "+via, "IAM role", rolearn)
+		}
+	}
+	for sakey, sa := range ag.ServiceAccounts {
+		for _, secret := range sa.Secrets {
+			add("Kubernetes service account", sakey, "has secret", "Kubernetes secret", kubekey(sa.ClusterName, sa.Namespace, secret.Name))
+		}
+	}
+	bind := func(btype, bkey, cluster, ns string, subjects []Subject, roleref RoleRef) {
+		if roleref.Kind == "ClusterRole" {
+			add(btype, bkey, "grants", "Kubernetes cluster role", kubekey(cluster, "", roleref.Name))
+		} else {
+			add(btype, bkey, "grants", "Kubernetes role", kubekey(cluster, ns, roleref.Name))
+		}
+		for _, s := range subjects {
+			switch s.Kind {
+			case "ServiceAccount":
+				sns := s.Namespace
+				if sns == "" {
+					sns = ns
+				}
+				add("Kubernetes service account", kubekey(cluster, sns, s.Name), "is bound by", btype, bkey)
+			default:
+				add("Kubernetes "+strings.ToLower(s.Kind), kubekey(cluster, "", s.Name), "is bound by", btype, bkey)
+			}
+		}
+	}
+	for bkey, rb := range ag.KubeRoleBindings {
+		bind("Kubernetes role binding", bkey, rb.ClusterName, rb.Namespace, rb.Subjects, rb.RoleRef)
+	}
+	for bkey, crb := range ag.KubeClusterRoleBindings {
+		bind("Kubernetes cluster role binding", bkey, crb.ClusterName, "", crb.Subjects, crb.RoleRef)
+	}
+	for cluster, awsauth := range ag.AWSAuth {
+		if awsauth == nil {
+			continue
+		}
+		mapto := func(itype, arn, username string, groups []string) {
+			add(itype, arn, "maps to", "Kubernetes user", kubekey(cluster, "", username))
+			for _, group := range groups {
+				add(itype, arn, "maps to", "Kubernetes group", kubekey(cluster, "", group))
+			}
+		}
+		for _, rm := range awsauth.MapRoles {
+			mapto("IAM role", rm.RoleARN, rm.Username, rm.Groups)
+		}
+		for _, um := range awsauth.MapUsers {
+			mapto("IAM user", um.UserARN, um.Username, um.Groups)
+		}
+	}
+	return edges
+}
+
+// sortEdges orders edges by their textual rendering, for a stable output.
+func sortEdges(edges []Edge) {
+	sort.Slice(edges, func(i, j int) bool {
+		return edges[i].String() < edges[j].String()
+	})
+}
+
+// formatDiff provides a textual rendering of the differences between two
+// access graphs, with + marking added, - removed and ~ changed entities
+// and edges.
+func formatDiff(d GraphDiff) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("     From: %v\n     To: %v\n", d.From, d.To))
+	if len(d.Entities) == 0 && len(d.AddedEdges) == 0 && len(d.RemovedEdges) == 0 {
+		b.WriteString("     No differences\n")
+		return b.String()
+	}
+	if len(d.Entities) > 0 {
+		b.WriteString(formatDeltas(d.Entities))
+	}
+	if len(d.AddedEdges)+len(d.RemovedEdges) > 0 {
+		b.WriteString(fmt.Sprintf("     Edges: %v added, %v removed", len(d.AddedEdges), len(d.RemovedEdges)))
+		for _, e := range d.AddedEdges {
+			b.WriteString("\n      + " + e.String())
+		}
+		for _, e := range d.RemovedEdges {
+			b.WriteString("\n      - " + e.String())
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
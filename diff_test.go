@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffGraphs(t *testing.T) {
+	from, to := fixtureGraph(t), fixtureGraph(t)
+	if d := diffGraphs(from, to, "before", "after"); len(d.AddedEdges) != 0 || len(d.RemovedEdges) != 0 {
+		t.Errorf("got edges %v added and %v removed between the same graphs, want none", d.AddedEdges, d.RemovedEdges)
+	}
+	delete(to.KubeRoleBindings, "default:read-pods")
+	d := diffGraphs(from, to, "before", "after")
+	if d.From != "before" || d.To != "after" {
+		t.Errorf("got diff from %v to %v, want from before to after", d.From, d.To)
+	}
+	want := map[Edge]bool{
+		{From: "[Kubernetes role binding] default:read-pods", Relation: "grants", To: "[Kubernetes role] default:pod-reader"}:                true,
+		{From: "[Kubernetes service account] default:s3-echoer", Relation: "is bound by", To: "[Kubernetes role binding] default:read-pods"}: true,
+	}
+	if len(d.AddedEdges) != 0 || len(d.RemovedEdges) != len(want) {
+		t.Fatalf("got edges %v added and %v removed, want the ones of read-pods removed", d.AddedEdges, d.RemovedEdges)
+	}
+	for _, e := range d.RemovedEdges {
+		if !want[e] {
+			t.Errorf("got removed edge %v, want only the ones of read-pods", e)
+		}
+	}
+	removed := []string{}
+	for _, delta := range d.Entities {
+		if delta.Kind == "Kubernetes role bindings" {
+			removed = delta.Removed
+		}
+	}
+	if len(removed) != 1 || removed[0] != "default:read-pods" {
+		t.Errorf("got removed role bindings %v, want default:read-pods", removed)
+	}
+}
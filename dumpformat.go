@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// dumpFormat is the version of the format of dumps written by this version
+// of rbiam. Bump it whenever the access graph changes in a way older dumps
+// can't be loaded as is, and add a migration from the previous format.
+const dumpFormat = 2
+
+// DumpEnvelope is the format of dumps, describing the access graph along
+// with the access graph itself.
+type DumpEnvelope struct {
+	// Format is the version of the format, see dumpFormat.
+	Format int `json:"format"`
+	// RbiamVersion is the version of rbiam that wrote the dump.
+	RbiamVersion string `json:"rbiamVersion,omitempty"`
+	SnapshotInfo
+	// Graph is the access graph in the given format.
+	Graph json.RawMessage `json:"graph"`
+}
+
+// migrations upgrade dumps from one format to the next, with migrations[n]
+// upgrading a dump of format n to format n+1.
+var migrations = []func(env *DumpEnvelope, graph map[string]json.RawMessage) error{
+	migrateLegacyDump,
+	migrateInstanceKeys,
+}
+
+// marshalDump encodes the access graph as a dump of the current format,
+// along with info, and strips the payload of secrets unless withsecrets is
+// true.
+func marshalDump(ag *AccessGraph, withsecrets bool, info *SnapshotInfo) ([]byte, error) {
+	graph, err := marshalGraph(ag, withsecrets)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(DumpEnvelope{
+		Format:       dumpFormat,
+		RbiamVersion: Version,
+		SnapshotInfo: *info,
+		Graph:        graph,
+	})
+}
+
+// decodeDump decodes the plain dump b and migrates it to the current format.
+// Dumps written by newer versions of rbiam, in a format we don't know yet,
+// are rejected.
+func decodeDump(b []byte) (*DumpEnvelope, error) {
+	fields := make(map[string]json.RawMessage)
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("not an rbiam dump, expected a JSON object")
+	}
+	env := &DumpEnvelope{}
+	if _, ok := fields["graph"]; ok {
+		err = json.Unmarshal(b, env)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dump: %v", err)
+		}
+	} else {
+		// dumps used to be the bare access graph, which we call format 0:
+		env.Graph = b
+	}
+	if env.Format > dumpFormat {
+		return nil, fmt.Errorf("the dump has format %v, written by rbiam %v, but this version of rbiam only supports formats up to %v, please upgrade rbiam", env.Format, env.RbiamVersion, dumpFormat)
+	}
+	if env.Format < 0 {
+		return nil, fmt.Errorf("invalid dump format %v", env.Format)
+	}
+	if env.Format == dumpFormat {
+		return env, nil
+	}
+	graph := make(map[string]json.RawMessage)
+	err = json.Unmarshal(env.Graph, &graph)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access graph in dump: %v", err)
+	}
+	for ; env.Format < dumpFormat; env.Format++ {
+		err = migrations[env.Format](env, graph)
+		if err != nil {
+			return nil, fmt.Errorf("can't migrate dump from format %v to %v: %v", env.Format, env.Format+1, err)
+		}
+	}
+	env.Graph, err = json.Marshal(graph)
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// migrateLegacyDump upgrades a bare access graph, format 0, to format 1:
+//
+//   - the aws-auth mappings of a single cluster become a map keyed by cluster
+//   - the account of the caller is added if the dump predates multiple accounts
+//   - the metadata of the snapshot moves from the access graph into the
+//     envelope, falling back to the accounts and contexts in the access graph
+func migrateLegacyDump(env *DumpEnvelope, graph map[string]json.RawMessage) error {
+	if raw, ok := graph["AWSAuth"]; ok && !isNull(raw) {
+		awsauth := make(map[string]json.RawMessage)
+		err := json.Unmarshal(raw, &awsauth)
+		if err != nil {
+			return fmt.Errorf("invalid aws-auth mappings: %v", err)
+		}
+		_, maproles := awsauth["mapRoles"]
+		_, mapusers := awsauth["mapUsers"]
+		_, mapaccounts := awsauth["mapAccounts"]
+		if maproles || mapusers || mapaccounts {
+			graph["AWSAuth"], err = json.Marshal(map[string]json.RawMessage{"": raw})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := graph["Accounts"]; (!ok || isNull(raw)) && !isNull(graph["Caller"]) {
+		caller := &sts.GetCallerIdentityOutput{}
+		err := json.Unmarshal(graph["Caller"], caller)
+		if err != nil {
+			return fmt.Errorf("invalid caller: %v", err)
+		}
+		if caller.Account != nil {
+			graph["Accounts"], err = json.Marshal(map[string]Account{
+				*caller.Account: {ID: *caller.Account, Caller: caller},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if raw, ok := graph["Snapshot"]; ok {
+		delete(graph, "Snapshot")
+		if !isNull(raw) {
+			err := json.Unmarshal(raw, &env.SnapshotInfo)
+			if err != nil {
+				return fmt.Errorf("invalid snapshot info: %v", err)
+			}
+			return nil
+		}
+	}
+	accounts := make(map[string]json.RawMessage)
+	var kubecontexts []string
+	var kubeconfig *Config
+	for field, v := range map[string]interface{}{"Accounts": &accounts, "KubeContexts": &kubecontexts, "KubeConfig": &kubeconfig} {
+		if raw := graph[field]; !isNull(raw) {
+			err := json.Unmarshal(raw, v)
+			if err != nil {
+				return fmt.Errorf("invalid %v: %v", field, err)
+			}
+		}
+	}
+	for account := range accounts {
+		env.Accounts = append(env.Accounts, account)
+	}
+	sort.Strings(env.Accounts)
+	env.Contexts = kubeContextsOf(kubecontexts, kubeconfig)
+	return nil
+}
+
+// migrateInstanceKeys upgrades a dump of format 1 to format 2:
+//
+//   - the EC2 instances, keyed by their private IP address, are keyed by the
+//     account they run in and their private IP address, taking the account
+//     from the instance profile of the instance, falling back to the caller's
+//     account
+//   - the number of entities each policy is attached to is recorded per
+//     account, the account owning the policy or, for AWS managed policies,
+//     the only account of the dump, falling back to the caller's account
+func migrateInstanceKeys(env *DumpEnvelope, graph map[string]json.RawMessage) error {
+	caller := &sts.GetCallerIdentityOutput{}
+	accounts := make(map[string]json.RawMessage)
+	instances := make(map[string]ec2.Instance)
+	policies := make(map[string]iam.Policy)
+	for field, v := range map[string]interface{}{"Caller": caller, "Accounts": &accounts, "Instances": &instances, "Policies": &policies} {
+		if raw := graph[field]; !isNull(raw) {
+			err := json.Unmarshal(raw, v)
+			if err != nil {
+				return fmt.Errorf("invalid %v: %v", field, err)
+			}
+		}
+	}
+	defaultaccount := aws.StringValue(caller.Account)
+	if len(accounts) == 1 {
+		for account := range accounts {
+			defaultaccount = account
+		}
+	}
+	var err error
+	if len(instances) > 0 {
+		keyed := make(map[string]ec2.Instance)
+		for ip, instance := range instances {
+			account := aws.StringValue(caller.Account)
+			if instance.IamInstanceProfile != nil {
+				if owner := arnAccount(aws.StringValue(instance.IamInstanceProfile.Arn)); owner != "" {
+					account = owner
+				}
+			}
+			keyed[instanceKey(account, ip)] = instance
+		}
+		graph["Instances"], err = json.Marshal(keyed)
+		if err != nil {
+			return err
+		}
+	}
+	if len(policies) > 0 {
+		attachments := make(map[string]map[string]int64)
+		for policyarn, policy := range policies {
+			account := arnAccount(policyarn)
+			if account == "aws" || account == "" {
+				account = defaultaccount
+			}
+			attachments[policyarn] = map[string]int64{account: aws.Int64Value(policy.AttachmentCount)}
+		}
+		graph["PolicyAttachments"], err = json.Marshal(attachments)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNull checks if the JSON value raw is missing or null.
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMigrateLegacyDump(t *testing.T) {
+	dump := `{
+		"Caller": {"Account": "123456789012", "Arn": "arn:aws:iam::123456789012:user/alice"},
+		"AWSAuth": {"mapRoles": [{"rolearn": "arn:aws:iam::123456789012:role/eks-admin", "username": "admin", "groups": ["system:masters"]}]},
+		"Instances": {"192.168.12.34": {"InstanceId": "i-0123456789abcdef0"}},
+		"Snapshot": {"name": "before-upgrade"}
+	}`
+	env, err := decodeDump([]byte(dump))
+	if err != nil {
+		t.Fatalf("can't decode legacy dump: %v", err)
+	}
+	if env.Format != dumpFormat || env.Name != "before-upgrade" {
+		t.Errorf("got format %v and snapshot %+v, want format %v of before-upgrade", env.Format, env.SnapshotInfo, dumpFormat)
+	}
+	ag := &AccessGraph{}
+	err = json.Unmarshal(env.Graph, ag)
+	if err != nil {
+		t.Fatalf("can't decode migrated access graph: %v", err)
+	}
+	if _, ok := ag.Accounts["123456789012"]; !ok {
+		t.Errorf("got accounts %v, want the caller's account", ag.Accounts)
+	}
+	if rms := ag.roleMappings("arn:aws:iam::123456789012:role/eks-admin"); len(rms) != 1 || rms[0].Username != "admin" {
+		t.Errorf("got mappings %+v of eks-admin, want admin", rms)
+	}
+	if _, ok := ag.Instances["123456789012/192.168.12.34"]; !ok {
+		t.Errorf("got instances %v, want the one keyed by the caller's account", ag.Instances)
+	}
+}
+
+func TestDecodeDumpNewerFormat(t *testing.T) {
+	_, err := decodeDump([]byte(`{"format": 99, "rbiamVersion": "v9.9", "graph": {}}`))
+	if err == nil {
+		t.Errorf("got no error for a dump of a newer format")
+	}
+}
+
+func TestMigrateInstanceKeys(t *testing.T) {
+	dump := `{
+		"format": 1,
+		"graph": {
+			"Caller": {"Account": "123456789012"},
+			"Accounts": {"123456789012": {"ID": "123456789012"}, "210987654321": {"ID": "210987654321"}},
+			"Instances": {
+				"192.168.12.34": {"InstanceId": "i-0fedcba9876543210", "IamInstanceProfile": {"Arn": "arn:aws:iam::210987654321:instance-profile/batch-node"}},
+				"192.168.12.35": {"InstanceId": "i-0123456789abcdef1"}
+			},
+			"Policies": {
+				"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess": {"AttachmentCount": 4},
+				"arn:aws:iam::210987654321:policy/batch": {"AttachmentCount": 1}
+			}
+		}
+	}`
+	env, err := decodeDump([]byte(dump))
+	if err != nil {
+		t.Fatalf("can't decode dump: %v", err)
+	}
+	if env.Format != dumpFormat {
+		t.Errorf("got format %v, want %v", env.Format, dumpFormat)
+	}
+	ag := &AccessGraph{}
+	err = json.Unmarshal(env.Graph, ag)
+	if err != nil {
+		t.Fatalf("can't decode migrated access graph: %v", err)
+	}
+	for _, key := range []string{"210987654321/192.168.12.34", "123456789012/192.168.12.35"} {
+		if _, ok := ag.Instances[key]; !ok {
+			t.Errorf("instance %v not found in %v", key, ag.Instances)
+		}
+	}
+	want := map[string]map[string]int64{
+		"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess": {"123456789012": 4},
+		"arn:aws:iam::210987654321:policy/batch":         {"210987654321": 1},
+	}
+	for policyarn, w := range want {
+		got := ag.PolicyAttachments[policyarn]
+		for account, count := range w {
+			if len(got) != len(w) || got[account] != count {
+				t.Errorf("got attachments %v of %v, want %v", got, policyarn, w)
+			}
+		}
+	}
+}
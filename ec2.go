@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// Instances queries EC2 for the instances in the current region, following
+// the next token until all pages have been retrieved.
+func (src awsSource) Instances() ([]ec2.Instance, error) {
+	svc := ec2.New(src.cfg)
+	instances := []ec2.Instance{}
+	var nexttoken *string
+	for {
+		req := svc.DescribeInstancesRequest(&ec2.DescribeInstancesInput{NextToken: nexttoken})
+		res, err := req.Send(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range res.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+		if res.NextToken == nil || *res.NextToken == "" {
+			break
+		}
+		nexttoken = res.NextToken
+	}
+	return instances, nil
+}
+
+// instances retrieves the EC2 instances of the account src gives access to,
+// keyed by account and private IP address, see instanceKey(), which allows
+// to look up the node a pod runs on via the pod's host IP. Private IP
+// addresses are only unique within a VPC, so we need the account to tell
+// apart instances of accounts with overlapping VPC CIDRs.
+func (ag *AccessGraph) instances(src IAMSource, account string) error {
+	instances, err := src.Instances()
+	if err != nil {
+		return err
+	}
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.Instances == nil {
+		ag.Instances = make(map[string]ec2.Instance)
+	}
+	for _, instance := range instances {
+		if instance.PrivateIpAddress == nil {
+			continue
+		}
+		ag.Instances[instanceKey(account, *instance.PrivateIpAddress)] = instance
+	}
+	return nil
+}
+
+// instanceKey builds the key of an EC2 instance in the access graph from
+// the account it runs in and its private IP address: ACCOUNT/IP.
+func instanceKey(account, ip string) string {
+	return account + "/" + ip
+}
+
+// nodeRole returns the ARN of the IAM role of the instance profile of the
+// EC2 instance the pod runs on, if any. This is the traditional, node-level
+// IAM role assignment, effective for pods that don't use IRSA. We look up
+// the instance in the account of the pod's cluster, see clusterAccount().
+func (ag *AccessGraph) nodeRole(pod *Pod) (string, bool) {
+	instance, ok := ag.Instances[instanceKey(ag.clusterAccount(pod.ClusterName), pod.Status.HostIP)]
+	if !ok || instance.IamInstanceProfile == nil {
+		return "", false
+	}
+	profile, ok := ag.InstanceProfiles[*instance.IamInstanceProfile.Arn]
+	if !ok || len(profile.Roles) == 0 {
+		return "", false
+	}
+	return *profile.Roles[0].Arn, true
+}
+
+// podRole returns the ARN of the IAM role that effectively serves as the
+// AWS identity of the pod along with how it's assigned: via IRSA, in case
+// the pod has the AWS_ROLE_ARN environment variable set or its service
+// account is annotated, or otherwise via the node's instance profile.
+func (ag *AccessGraph) podRole(pod *Pod) (rolearn, via string) {
+	for _, container := range pod.Spec.Containers {
+		for _, envar := range container.Env {
+			if envar.Name == "AWS_ROLE_ARN" {
+				return envar.Value, "IRSA"
+			}
+		}
+	}
+	sa := ag.ServiceAccounts[kubekey(pod.ClusterName, pod.Namespace, pod.Spec.ServiceAccountName)]
+	if rolearn, ok := sa.Annotations[irsaAnnotation]; ok {
+		return rolearn, "IRSA"
+	}
+	if rolearn, ok := ag.nodeRole(pod); ok {
+		return rolearn, "node instance profile"
+	}
+	return "", ""
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// multiAccountGraph builds the access graph of the fixture tree along with
+// a second account, which has an instance with the same private IP address.
+func multiAccountGraph(t *testing.T) *AccessGraph {
+	t.Helper()
+	ag, report := NewAccessGraph(
+		map[string]IAMSource{
+			"":      newIAMFixtures(filepath.Join(fixtureDir, "iam")),
+			"other": newIAMFixtures(filepath.Join("testdata", "other-account", "iam")),
+		},
+		map[string]KubeSource{"": kubeFixtures{dir: filepath.Join(fixtureDir, "k8s")}},
+	)
+	if failed := report.failed(); len(failed) > 0 {
+		t.Fatalf("collectors failed:\n%v", formatFailures(report))
+	}
+	return ag
+}
+
+func TestNodeRoleOverlappingAccounts(t *testing.T) {
+	ag := multiAccountGraph(t)
+	if len(ag.Instances) != 2 {
+		t.Fatalf("got %v instances, want one per account", len(ag.Instances))
+	}
+	pod := ag.Pods["default:web-7d4c5b"]
+	rolearn, ok := ag.nodeRole(&pod)
+	if !ok || rolearn != "arn:aws:iam::123456789012:role/eks-node" {
+		t.Errorf("got node role %v, want the one of the caller's account", rolearn)
+	}
+	// the cluster, named by its ARN, runs in the other account:
+	ag.KubeConfig.Clusters[0].Name = "arn:aws:eks:us-west-2:210987654321:cluster/demo"
+	ag.KubeConfig.Contexts[0].Context.Cluster = ag.KubeConfig.Clusters[0].Name
+	if account := ag.clusterAccount(""); account != "210987654321" {
+		t.Errorf("got cluster account %v, want 210987654321", account)
+	}
+	rolearn, ok = ag.nodeRole(&pod)
+	if !ok || rolearn != "arn:aws:iam::210987654321:role/batch-node" {
+		t.Errorf("got node role %v, want the one of the other account", rolearn)
+	}
+}
+
+func TestPolicyAttachmentsPerAccount(t *testing.T) {
+	ag := multiAccountGraph(t)
+	want := map[string]int64{"123456789012": 1, "210987654321": 4}
+	got := ag.PolicyAttachments["arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"]
+	if len(got) != len(want) || got["123456789012"] != 1 || got["210987654321"] != 4 {
+		t.Errorf("got attachments %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Encrypted dumps are JSON documents with a random file key encrypting the
+// access graph with AES-256-GCM. The file key itself is wrapped once per
+// recipient, either with a key derived from a passphrase via PBKDF2 or, for
+// X25519 public keys, with a key agreed on via an ephemeral key pair, so any
+// of the recipients can decrypt the dump. The header, that is, everything
+// but the payload, is the additional data of the payload's AES-GCM, so
+// swapping, adding or removing recipients or changing their parameters
+// makes decryption fail. This follows the design of age, which we can't use
+// directly since age doesn't allow a passphrase along with public keys.
+// X25519 needs crypto/ecdh, so rbiam needs Go 1.20 or later to build.
+
+// encryptedFormat is the version of the format of encrypted dumps. Format 1
+// didn't authenticate the header, we still decrypt such dumps.
+const encryptedFormat = 2
+
+// passphraseIterations is the number of PBKDF2 iterations for deriving keys
+// from passphrases, following the OWASP recommendation for HMAC-SHA256.
+// When decrypting, we accept up to maxPassphraseIterations, so a dump can't
+// make us spin for ages, nor weaken the passphrase with fewer iterations.
+const (
+	passphraseIterations    = 600000
+	maxPassphraseIterations = 10 * passphraseIterations
+)
+
+// publicKeyPrefix and privateKeyPrefix mark the encoded X25519 keys.
+const (
+	publicKeyPrefix  = "rbiam-pub:"
+	privateKeyPrefix = "rbiam-key:"
+)
+
+// EncryptedDump is the format of an encrypted dump.
+type EncryptedDump struct {
+	// Encrypted is the version of the format, which also tells encrypted
+	// dumps from plain ones.
+	Encrypted int `json:"rbiamEncrypted"`
+	// Recipients are the wrapped file keys, one per recipient.
+	Recipients []Recipient `json:"recipients"`
+	// Nonce and Payload are the nonce and the encrypted access graph.
+	Nonce   []byte `json:"nonce"`
+	Payload []byte `json:"payload"`
+}
+
+// Recipient is the file key of an encrypted dump, wrapped for one recipient.
+type Recipient struct {
+	// Type is either 'passphrase' or 'x25519'.
+	Type string `json:"type"`
+	// Salt and Iterations are the PBKDF2 parameters for passphrases.
+	Salt       []byte `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	// PublicKey is the public key of the recipient and Ephemeral the public
+	// key of the ephemeral key pair, for X25519.
+	PublicKey string `json:"publicKey,omitempty"`
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+	// Nonce and WrappedKey are the nonce and the encrypted file key.
+	Nonce      []byte `json:"nonce"`
+	WrappedKey []byte `json:"wrappedKey"`
+}
+
+// dumpEncryption returns the passphrase and the public keys to encrypt dumps
+// with, as set via the RBIAM_DUMP_PASSPHRASE and RBIAM_DUMP_RECIPIENTS
+// environment variables, the latter being a comma-separated list. Dumps are
+// written in plain text if neither is set.
+func dumpEncryption() (string, []string) {
+	return os.Getenv("RBIAM_DUMP_PASSPHRASE"), splitList(os.Getenv("RBIAM_DUMP_RECIPIENTS"))
+}
+
+// encryptDump encrypts the plaintext so that it can be decrypted with the
+// passphrase, if not empty, or any of the private keys of the recipients.
+func encryptDump(plaintext []byte, passphrase string, recipients []string) ([]byte, error) {
+	filekey := make([]byte, 32)
+	_, err := rand.Read(filekey)
+	if err != nil {
+		return nil, err
+	}
+	ed := EncryptedDump{Encrypted: encryptedFormat}
+	if passphrase != "" {
+		r := Recipient{Type: "passphrase", Salt: make([]byte, 16), Iterations: passphraseIterations}
+		_, err = rand.Read(r.Salt)
+		if err != nil {
+			return nil, err
+		}
+		r.Nonce, r.WrappedKey, err = seal(passphraseKey(passphrase, r.Salt, r.Iterations), filekey, nil)
+		if err != nil {
+			return nil, err
+		}
+		ed.Recipients = append(ed.Recipients, r)
+	}
+	for _, pubkey := range recipients {
+		pub, err := parsePublicKey(pubkey)
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(pub)
+		if err != nil {
+			return nil, err
+		}
+		r := Recipient{Type: "x25519", PublicKey: pubkey, Ephemeral: ephemeral.PublicKey().Bytes()}
+		r.Nonce, r.WrappedKey, err = seal(wrappingKey(shared, r.Ephemeral, pub.Bytes()), filekey, nil)
+		if err != nil {
+			return nil, err
+		}
+		ed.Recipients = append(ed.Recipients, r)
+	}
+	if len(ed.Recipients) == 0 {
+		return nil, fmt.Errorf("need a passphrase or at least one recipient to encrypt")
+	}
+	header, err := ed.header()
+	if err != nil {
+		return nil, err
+	}
+	ed.Nonce, ed.Payload, err = seal(filekey, plaintext, header)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ed)
+}
+
+// header returns the serialized header of the encrypted dump, which is the
+// dump without the payload and its nonce.
+func (ed EncryptedDump) header() ([]byte, error) {
+	ed.Nonce, ed.Payload = nil, nil
+	return json.Marshal(ed)
+}
+
+// isEncrypted checks if the dump b is encrypted.
+func isEncrypted(b []byte) bool {
+	var ed struct {
+		Encrypted int `json:"rbiamEncrypted"`
+	}
+	return json.Unmarshal(b, &ed) == nil && ed.Encrypted != 0
+}
+
+// decryptDump decrypts the encrypted dump b with the passphrase, if not
+// empty, or any of the private keys in identities.
+func decryptDump(b []byte, passphrase string, identities []*ecdh.PrivateKey) ([]byte, error) {
+	ed := EncryptedDump{}
+	err := json.Unmarshal(b, &ed)
+	if err != nil {
+		return nil, err
+	}
+	var header []byte
+	switch ed.Encrypted {
+	case 1:
+		// the header isn't authenticated
+	case encryptedFormat:
+		header, err = ed.header()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption format %v", ed.Encrypted)
+	}
+	for _, r := range ed.Recipients {
+		if r.Type == "passphrase" && (r.Iterations < passphraseIterations || r.Iterations > maxPassphraseIterations) {
+			return nil, fmt.Errorf("invalid encrypted dump, passphrases need %v to %v PBKDF2 iterations, got %v", passphraseIterations, maxPassphraseIterations, r.Iterations)
+		}
+	}
+	for _, r := range ed.Recipients {
+		if filekey := unwrap(r, passphrase, identities); filekey != nil {
+			plaintext, err := open(filekey, ed.Nonce, ed.Payload, header)
+			if err != nil {
+				return nil, fmt.Errorf("can't decrypt dump, it has been tampered with or is corrupt: %v", err)
+			}
+			return plaintext, nil
+		}
+	}
+	return nil, fmt.Errorf("can't decrypt dump, the passphrase in RBIAM_DUMP_PASSPHRASE is wrong or none of the keys in RBIAM_DUMP_IDENTITY is a recipient")
+}
+
+// unwrap returns the file key wrapped for the recipient r, if the passphrase
+// or any of the private keys in identities belong to it, and nil otherwise.
+func unwrap(r Recipient, passphrase string, identities []*ecdh.PrivateKey) []byte {
+	switch r.Type {
+	case "passphrase":
+		if passphrase == "" {
+			return nil
+		}
+		filekey, err := open(passphraseKey(passphrase, r.Salt, r.Iterations), r.Nonce, r.WrappedKey, nil)
+		if err != nil {
+			return nil
+		}
+		return filekey
+	case "x25519":
+		ephemeral, err := ecdh.X25519().NewPublicKey(r.Ephemeral)
+		if err != nil {
+			return nil
+		}
+		for _, priv := range identities {
+			if publicKey(priv) != r.PublicKey {
+				continue
+			}
+			shared, err := priv.ECDH(ephemeral)
+			if err != nil {
+				continue
+			}
+			filekey, err := open(wrappingKey(shared, r.Ephemeral, priv.PublicKey().Bytes()), r.Nonce, r.WrappedKey, nil)
+			if err == nil {
+				return filekey
+			}
+		}
+	}
+	return nil
+}
+
+// decryptIfNeeded returns the plain dump b, decrypting it with the
+// passphrase and the private keys set via RBIAM_DUMP_PASSPHRASE and
+// RBIAM_DUMP_IDENTITY, respectively, if it's encrypted.
+func decryptIfNeeded(b []byte) ([]byte, error) {
+	if !isEncrypted(b) {
+		return b, nil
+	}
+	passphrase := os.Getenv("RBIAM_DUMP_PASSPHRASE")
+	identities, err := loadIdentities(os.Getenv("RBIAM_DUMP_IDENTITY"))
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" && len(identities) == 0 {
+		return nil, fmt.Errorf("dump is encrypted, set RBIAM_DUMP_PASSPHRASE or RBIAM_DUMP_IDENTITY to decrypt it")
+	}
+	return decryptDump(b, passphrase, identities)
+}
+
+// loadIdentities reads the private keys from the key file filename, one per
+// line, skipping empty lines and comments starting with '#'. An empty
+// filename means no keys.
+func loadIdentities(filename string) ([]*ecdh.PrivateKey, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't read key file %v: %v", filename, err)
+	}
+	identities := []*ecdh.PrivateKey{}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		priv, err := parsePrivateKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse key file %v: %v", filename, err)
+		}
+		identities = append(identities, priv)
+	}
+	return identities, nil
+}
+
+// generateKey creates a new X25519 key pair and returns it encoded, in the
+// format of key files.
+func generateKey() (string, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("# public key: %v\n%v%v\n", publicKey(priv), privateKeyPrefix, base64.RawURLEncoding.EncodeToString(priv.Bytes())), nil
+}
+
+// publicKey returns the encoded public key of the private key priv.
+func publicKey(priv *ecdh.PrivateKey) string {
+	return publicKeyPrefix + base64.RawURLEncoding.EncodeToString(priv.PublicKey().Bytes())
+}
+
+// parsePublicKey decodes a public key in the format 'rbiam-pub:...'.
+func parsePublicKey(s string) (*ecdh.PublicKey, error) {
+	if !strings.HasPrefix(s, publicKeyPrefix) {
+		return nil, fmt.Errorf("invalid public key %q, expected %v followed by the key", s, publicKeyPrefix)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, publicKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %q: %v", s, err)
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// parsePrivateKey decodes a private key in the format 'rbiam-key:...'.
+func parsePrivateKey(s string) (*ecdh.PrivateKey, error) {
+	if !strings.HasPrefix(s, privateKeyPrefix) {
+		return nil, fmt.Errorf("invalid private key, expected %v followed by the key", privateKeyPrefix)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, privateKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+// seal encrypts plaintext with AES-256-GCM using key and a random nonce,
+// authenticating the additional data ad along with it.
+func seal(key, plaintext, ad []byte) ([]byte, []byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+// open decrypts ciphertext sealed with key, nonce and additional data ad.
+func open(key, nonce, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// newAEAD sets up AES-GCM with key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrappingKey derives the key wrapping the file key for an X25519 recipient
+// from the shared secret via HKDF-SHA256, binding it to both public keys.
+func wrappingKey(shared, ephemeral, recipient []byte) []byte {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("rbiam x25519")), key)
+	if err != nil {
+		// can't happen, HKDF-SHA256 provides up to 8160 bytes:
+		panic(err)
+	}
+	return key
+}
+
+// passphraseKey derives a 32 byte key from the passphrase via PBKDF2 with
+// HMAC-SHA256.
+func passphraseKey(passphrase string, salt []byte, iterations int) []byte {
+	return pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDumpRoundTrip(t *testing.T) {
+	keyfile, err := generateKey()
+	if err != nil {
+		t.Fatalf("can't generate key: %v", err)
+	}
+	priv, err := parsePrivateKey(strings.TrimSpace(strings.Split(keyfile, "\n")[1]))
+	if err != nil {
+		t.Fatalf("can't parse generated key: %v", err)
+	}
+	plaintext := []byte(`{"format": 2, "graph": {}}`)
+	b, err := encryptDump(plaintext, "correct horse battery staple", []string{publicKey(priv)})
+	if err != nil {
+		t.Fatalf("can't encrypt dump: %v", err)
+	}
+	if !isEncrypted(b) || isEncrypted(plaintext) {
+		t.Errorf("can't tell encrypted from plain dumps")
+	}
+	tests := []struct {
+		name       string
+		passphrase string
+		identities []*ecdh.PrivateKey
+		ok         bool
+	}{
+		{"passphrase", "correct horse battery staple", nil, true},
+		{"key", "", []*ecdh.PrivateKey{priv}, true},
+		{"wrong passphrase", "incorrect horse battery staple", nil, false},
+		{"nothing", "", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := decryptDump(b, tt.passphrase, tt.identities)
+		if tt.ok && (err != nil || string(got) != string(plaintext)) {
+			t.Errorf("%v: got %q and error %v, want the plaintext", tt.name, got, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%v: got %q, want an error", tt.name, got)
+		}
+	}
+}
+
+func TestDecryptDumpIterations(t *testing.T) {
+	b, err := encryptDump([]byte("{}"), "secret", nil)
+	if err != nil {
+		t.Fatalf("can't encrypt dump: %v", err)
+	}
+	for _, iterations := range []int{0, 1, passphraseIterations - 1, maxPassphraseIterations + 1} {
+		ed := EncryptedDump{}
+		err = json.Unmarshal(b, &ed)
+		if err != nil {
+			t.Fatalf("can't decode encrypted dump: %v", err)
+		}
+		ed.Recipients[0].Iterations = iterations
+		tampered, err := json.Marshal(ed)
+		if err != nil {
+			t.Fatalf("can't encode encrypted dump: %v", err)
+		}
+		_, err = decryptDump(tampered, "secret", nil)
+		if err == nil || !strings.Contains(err.Error(), "PBKDF2 iterations") {
+			t.Errorf("got error %v for %v iterations, want them rejected", err, iterations)
+		}
+	}
+}
+
+func TestPassphraseKey(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 test vector, see RFC 7914, section 11:
+	got := hex.EncodeToString(passphraseKey("passwd", []byte("salt"), 1))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"
+	if got != want {
+		t.Errorf("got key %v, want %v", got, want)
+	}
+}
+
+// testKeys generates n X25519 key pairs.
+func testKeys(t *testing.T, n int) []*ecdh.PrivateKey {
+	t.Helper()
+	keys := []*ecdh.PrivateKey{}
+	for i := 0; i < n; i++ {
+		keyfile, err := generateKey()
+		if err != nil {
+			t.Fatalf("can't generate key: %v", err)
+		}
+		priv, err := parsePrivateKey(strings.TrimSpace(strings.Split(keyfile, "\n")[1]))
+		if err != nil {
+			t.Fatalf("can't parse generated key: %v", err)
+		}
+		keys = append(keys, priv)
+	}
+	return keys
+}
+
+func TestDecryptDumpTamperedHeader(t *testing.T) {
+	keys := testKeys(t, 2)
+	b, err := encryptDump([]byte("{}"), "secret", []string{publicKey(keys[0]), publicKey(keys[1])})
+	if err != nil {
+		t.Fatalf("can't encrypt dump: %v", err)
+	}
+	tampers := map[string]func(ed *EncryptedDump){
+		"stripped recipient": func(ed *EncryptedDump) {
+			ed.Recipients = ed.Recipients[:2]
+		},
+		"swapped recipients": func(ed *EncryptedDump) {
+			ed.Recipients[1], ed.Recipients[2] = ed.Recipients[2], ed.Recipients[1]
+		},
+		"changed iterations": func(ed *EncryptedDump) {
+			ed.Recipients[0].Iterations = passphraseIterations + 1
+		},
+		"changed salt": func(ed *EncryptedDump) {
+			ed.Recipients[0].Salt[0] ^= 1
+		},
+	}
+	for name, tamper := range tampers {
+		ed := EncryptedDump{}
+		err = json.Unmarshal(b, &ed)
+		if err != nil {
+			t.Fatalf("can't decode encrypted dump: %v", err)
+		}
+		tamper(&ed)
+		tampered, err := json.Marshal(ed)
+		if err != nil {
+			t.Fatalf("can't encode encrypted dump: %v", err)
+		}
+		got, err := decryptDump(tampered, "", keys[:1])
+		if err == nil || !strings.Contains(err.Error(), "tampered") {
+			t.Errorf("%v: got %q and error %v, want the dump rejected as tampered", name, got, err)
+		}
+	}
+	if got, err := decryptDump(b, "", keys[1:]); err != nil || string(got) != "{}" {
+		t.Errorf("got %q and error %v from the untampered dump, want the plaintext", got, err)
+	}
+}
+
+func TestDecryptLegacyDump(t *testing.T) {
+	keys := testKeys(t, 1)
+	filekey := make([]byte, 32)
+	ephemeral := testKeys(t, 1)[0]
+	shared, err := ephemeral.ECDH(keys[0].PublicKey())
+	if err != nil {
+		t.Fatalf("can't agree on key: %v", err)
+	}
+	r := Recipient{Type: "x25519", PublicKey: publicKey(keys[0]), Ephemeral: ephemeral.PublicKey().Bytes()}
+	r.Nonce, r.WrappedKey, err = seal(wrappingKey(shared, r.Ephemeral, keys[0].PublicKey().Bytes()), filekey, nil)
+	if err != nil {
+		t.Fatalf("can't wrap file key: %v", err)
+	}
+	// format 1 didn't authenticate the header:
+	ed := EncryptedDump{Encrypted: 1, Recipients: []Recipient{r}}
+	ed.Nonce, ed.Payload, err = seal(filekey, []byte("{}"), nil)
+	if err != nil {
+		t.Fatalf("can't encrypt payload: %v", err)
+	}
+	b, err := json.Marshal(ed)
+	if err != nil {
+		t.Fatalf("can't encode encrypted dump: %v", err)
+	}
+	if got, err := decryptDump(b, "", keys); err != nil || string(got) != "{}" {
+		t.Errorf("got %q and error %v, want the plaintext", got, err)
+	}
+}
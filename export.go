@@ -4,39 +4,74 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/emicklei/dot"
 )
 
-// dump exports the entire access graph.
-func dump(ag *AccessGraph) error {
-	b, err := json.Marshal(ag)
+// dump exports the entire access graph into a file in the snapshot directory,
+// see snapshotDir(), with a name of 'rbiam-dump-NNNNNNNNNN.json', or
+// 'rbiam-dump-NNNNNNNNNN-NAME.json' for a named snapshot, and returns the
+// path. The dump carries the metadata of the snapshot, see DumpEnvelope.
+// The payload of secrets is stripped unless withsecrets is true. The dump is
+// encrypted if a passphrase or recipients are set, see dumpEncryption(), and
+// only readable by the current user in any case.
+func dump(ag *AccessGraph, withsecrets bool, name string) (string, error) {
+	err := validateSnapshotName(name)
 	if err != nil {
-		return err
+		return "", err
+	}
+	info := snapshotInfo(ag, name)
+	b, err := marshalDump(ag, withsecrets, info)
+	if err != nil {
+		return "", err
+	}
+	if passphrase, recipients := dumpEncryption(); passphrase != "" || len(recipients) > 0 {
+		b, err = encryptDump(b, passphrase, recipients)
+		if err != nil {
+			return "", fmt.Errorf("can't encrypt dump: %v", err)
+		}
 	}
-	filename := fmt.Sprintf("rbiam-dump-%v.json", time.Now().Unix())
-	err = ioutil.WriteFile(filename, b, 0644)
-	return err
+	filename := filepath.Join(snapshotDir(), snapshotFilename(name, info.CapturedAt))
+	err = ioutil.WriteFile(filename, b, 0600)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
 }
 
-// load imports access graph from filename
+// load imports access graph from filename, decrypting it if needed and
+// migrating dumps of older formats, see decodeDump()
 func load(filename string) (*AccessGraph, error) {
 	ag := &AccessGraph{}
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return ag, err
 	}
-	err = json.Unmarshal(b, ag)
-	return ag, err
+	b, err = decryptIfNeeded(b)
+	if err != nil {
+		return ag, err
+	}
+	env, err := decodeDump(b)
+	if err != nil {
+		return ag, err
+	}
+	err = json.Unmarshal(env.Graph, ag)
+	if err != nil {
+		return &AccessGraph{}, fmt.Errorf("incompatible dump of format %v: %v", env.Format, err)
+	}
+	ag.Snapshot = &env.SnapshotInfo
+	return ag, nil
 }
 
 // exportRaw exports the trace as a raw dump in JSON format into a file
 // in the current working directory with a name of 'rbiam-trace-NNNNNNNNNN' with
 // the NNNNNNNNNN being the Unix timestamp of the creation time, for example:
 // rbiam-trace-1564315687.json
-func exportRaw(trace []string, ag *AccessGraph) (string, error) {
+// The payload of secrets is stripped unless withsecrets is true.
+func exportRaw(trace []string, ag *AccessGraph, withsecrets bool) (string, error) {
 	dump := ""
 	for _, item := range trace {
 		itype, ikey := extractTK(item)
@@ -60,7 +95,11 @@ func exportRaw(trace []string, ag *AccessGraph) (string, error) {
 			}
 			dump = fmt.Sprintf("%v\n%v", dump, string(b))
 		case "Kubernetes secret":
-			b, err := json.Marshal(ag.Secrets[ikey])
+			secret := ag.Secrets[ikey]
+			if !withsecrets {
+				secret = stripSecret(secret)
+			}
+			b, err := json.Marshal(secret)
 			if err != nil {
 				return "", err
 			}
@@ -71,11 +110,35 @@ func exportRaw(trace []string, ag *AccessGraph) (string, error) {
 				return "", err
 			}
 			dump = fmt.Sprintf("%v\n%v", dump, string(b))
+		case "Kubernetes role":
+			b, err := json.Marshal(ag.KubeRoles[ikey])
+			if err != nil {
+				return "", err
+			}
+			dump = fmt.Sprintf("%v\n%v", dump, string(b))
+		case "Kubernetes cluster role":
+			b, err := json.Marshal(ag.KubeClusterRoles[ikey])
+			if err != nil {
+				return "", err
+			}
+			dump = fmt.Sprintf("%v\n%v", dump, string(b))
+		case "Kubernetes role binding":
+			b, err := json.Marshal(ag.KubeRoleBindings[ikey])
+			if err != nil {
+				return "", err
+			}
+			dump = fmt.Sprintf("%v\n%v", dump, string(b))
+		case "Kubernetes cluster role binding":
+			b, err := json.Marshal(ag.KubeClusterRoleBindings[ikey])
+			if err != nil {
+				return "", err
+			}
+			dump = fmt.Sprintf("%v\n%v", dump, string(b))
 		}
 	}
 
 	filename := fmt.Sprintf("rbiam-trace-%v.json", time.Now().Unix())
-	err := ioutil.WriteFile(filename, []byte(dump), 0644)
+	err := ioutil.WriteFile(filename, []byte(dump), 0600)
 	if err != nil {
 		return "", err
 	}
@@ -97,10 +160,21 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 	lpod := formatAsPod(legend.Node("Kubernetes pod"))
 	lrole := formatAsRole(legend.Node("IAM role"))
 	lpolicy := formatAsPolicy(legend.Node("IAM policy"))
+	linline := formatAsInlinePolicy(legend.Node("IAM inline policy"))
+	lprincipal := formatAsPrincipal(legend.Node("IAM principal"))
+	lkrole := formatAsKubeRole(legend.Node("Kubernetes role"))
+	lsubject := formatAsSubject(legend.Node("Kubernetes user or group"))
 	legend.Edge(lpod, lsa, "uses").Attr("fontname", "Helvetica")
 	legend.Edge(lsa, lsecret, "has").Attr("fontname", "Helvetica")
+	legend.Edge(lsa, lrole, "IRSA").Attr("fontname", "Helvetica")
 	legend.Edge(lrole, lpolicy, "has").Attr("fontname", "Helvetica")
+	legend.Edge(lrole, linline, "has").Attr("fontname", "Helvetica")
 	legend.Edge(lpod, lrole, "assumes").Attr("fontname", "Helvetica")
+	legend.Edge(lprincipal, lrole, "can assume").Attr("fontname", "Helvetica")
+	legend.Edge(lprincipal, lrole, "can assume (cross-account)").Attr("fontname", "Helvetica").Attr("color", "darkorange")
+	legend.Edge(lsa, lkrole, "bound to").Attr("fontname", "Helvetica")
+	legend.Edge(lsubject, lkrole, "bound to").Attr("fontname", "Helvetica")
+	legend.Edge(lrole, lsubject, "aws-auth").Attr("fontname", "Helvetica")
 
 	// first let's draw the nodes and remember the
 	// graph entry points for traversals to later draw
@@ -110,6 +184,8 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 	secrets := make(map[string]dot.Node)
 	roles := make(map[string]dot.Node)
 	policies := make(map[string]dot.Node)
+	kroles := make(map[string]dot.Node)
+	bindings := make(map[string]bool)
 	for _, item := range trace {
 		itype, ikey := extractTK(item)
 		switch itype {
@@ -119,10 +195,21 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 			policies[ikey] = formatAsPolicy(g.Node(ikey))
 		case "Kubernetes service account":
 			sas[ikey] = formatAsServiceAccount(g.Node(ikey))
+			// the effective permissions show up as tooltip, for example in SVG:
+			sa := ag.ServiceAccounts[ikey]
+			sas[ikey].Attr("tooltip", formatPermissions(ag.saPermissions(sa.ClusterName, sa.Namespace, sa.Name)))
 		case "Kubernetes secret":
 			secrets[ikey] = formatAsSecret(g.Node(ikey))
 		case "Kubernetes pod":
 			pods[ikey] = formatAsPod(g.Node(ikey))
+		case "Kubernetes role":
+			kroles["Role "+ikey] = formatAsKubeRole(g.Node("Role " + ikey))
+		case "Kubernetes cluster role":
+			kroles["ClusterRole "+ikey] = formatAsKubeRole(g.Node("ClusterRole " + ikey))
+		case "Kubernetes role binding":
+			bindings["RoleBinding "+ikey] = true
+		case "Kubernetes cluster role binding":
+			bindings["ClusterRoleBinding "+ikey] = true
 		}
 	}
 
@@ -132,7 +219,8 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 		for _, item := range trace {
 			itype, ikey := extractTK(item)
 			if itype == "Kubernetes service account" {
-				podsa := namespaceit(ag.Pods[podname].Namespace, ag.Pods[podname].Spec.ServiceAccountName)
+				pod := ag.Pods[podname]
+				podsa := kubekey(pod.ClusterName, pod.Namespace, pod.Spec.ServiceAccountName)
 				if podsa == ikey {
 					g.Edge(node, sas[ikey])
 				}
@@ -144,10 +232,13 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 		for _, item := range trace {
 			itype, ikey := extractTK(item)
 			if itype == "Kubernetes secret" {
-				// for now we simply take the first secret of the service account, should really iterate over all and check each:
-				sasecrect := namespaceit(ag.ServiceAccounts[saname].Namespace, ag.ServiceAccounts[saname].Secrets[0].Name)
-				if sasecrect == ikey {
-					g.Edge(node, secrets[ikey])
+				// since Kubernetes 1.24 most service accounts have no token
+				// secrets at all, so there may be none to draw:
+				sa := ag.ServiceAccounts[saname]
+				for _, secret := range sa.Secrets {
+					if kubekey(sa.ClusterName, sa.Namespace, secret.Name) == ikey {
+						g.Edge(node, secrets[ikey])
+					}
 				}
 			}
 		}
@@ -165,15 +256,151 @@ func exportGraph(trace []string, ag *AccessGraph) (string, error) {
 						}
 					}
 				}
-				// for traditional, node-level IAM role assignment:
-				// iterate over EC2 instances and select the ones where the
-				// pods' hostIP matches, then take the EC2 NodeInstanceRole
 			}
 		}
 	}
+	// for traditional, node-level IAM role assignment we take the role of
+	// the instance profile of the node the pod runs on, for pods without IRSA.
+	// We draw the node role even if it's not part of the trace since it's
+	// the effective AWS identity of the pod:
+	for podname, node := range pods {
+		pod := ag.Pods[podname]
+		rolearn, via := ag.podRole(&pod)
+		if via != "node instance profile" {
+			continue
+		}
+		rolenode, ok := roles[rolearn]
+		if !ok {
+			rolenode = formatAsRole(g.Node(rolearn))
+			roles[rolearn] = rolenode
+		}
+		g.Edge(node, rolenode, "via node").Attr("fontname", "Helvetica")
+	}
+
+	// service accounts -> IAM roles, via IRSA:
+	for _, l := range ag.irsaLinks() {
+		sanode, ok := sas[l.ServiceAccount]
+		if !ok {
+			continue
+		}
+		rolenode, ok := roles[l.Role]
+		if !ok {
+			continue
+		}
+		e := g.Edge(sanode, rolenode, "IRSA").Attr("fontname", "Helvetica")
+		if l.mismatch() {
+			e.Attr("label", "IRSA mismatch").Attr("color", "red").Attr("style", "dashed")
+		}
+	}
+
+	// IAM roles -> Kubernetes users and groups, via aws-auth:
+	// with several clusters, users and groups are per cluster:
+	for rolearn, node := range roles {
+		for _, rm := range ag.roleMappings(rolearn) {
+			usernode := formatAsSubject(g.Node("User " + kubekey(rm.Cluster, "", rm.Username)))
+			g.Edge(node, usernode, "aws-auth").Attr("fontname", "Helvetica")
+			for _, group := range rm.Groups {
+				groupnode := formatAsSubject(g.Node("Group " + kubekey(rm.Cluster, "", group)))
+				g.Edge(node, groupnode, "aws-auth").Attr("fontname", "Helvetica")
+			}
+		}
+	}
+
+	// subjects -> Kubernetes roles, via role bindings and cluster role bindings.
+	// For bindings that are part of the trace we draw all subjects and the
+	// role, otherwise only if both the subject and the role are in the trace:
+	bindsubjects := func(bindingid, bindingname, cluster, ns string, subjects []Subject, roleref RoleRef) {
+		traced := bindings[bindingid]
+		roleid := roleref.Kind + " " + kubekey(cluster, "", roleref.Name)
+		if roleref.Kind == "Role" {
+			roleid = roleref.Kind + " " + kubekey(cluster, ns, roleref.Name)
+		}
+		rolenode, ok := kroles[roleid]
+		if !ok {
+			if !traced {
+				return
+			}
+			rolenode = formatAsKubeRole(g.Node(roleid))
+			kroles[roleid] = rolenode
+		}
+		for _, subject := range subjects {
+			var subjectnode dot.Node
+			switch subject.Kind {
+			case "ServiceAccount":
+				sakey := kubekey(cluster, subject.Namespace, subject.Name)
+				sanode, ok := sas[sakey]
+				if !ok {
+					if !traced {
+						continue
+					}
+					sanode = formatAsServiceAccount(g.Node(sakey))
+				}
+				subjectnode = sanode
+			default:
+				if !traced {
+					continue
+				}
+				subjectnode = formatAsSubject(g.Node(subject.Kind + " " + kubekey(cluster, "", subject.Name)))
+			}
+			g.Edge(subjectnode, rolenode, bindingname).Attr("fontname", "Helvetica")
+		}
+	}
+	for rbname, rb := range ag.KubeRoleBindings {
+		bindsubjects("RoleBinding "+rbname, rb.Name, rb.ClusterName, rb.Namespace, rb.Subjects, rb.RoleRef)
+	}
+	for crbname, crb := range ag.KubeClusterRoleBindings {
+		bindsubjects("ClusterRoleBinding "+crbname, crb.Name, crb.ClusterName, "", crb.Subjects, crb.RoleRef)
+	}
 
 	// IAM roles -> IAM policies
-	// https://godoc.org/github.com/aws/aws-sdk-go-v2/service/iam#Client.ListAttachedRolePoliciesRequest
+	for rolearn, node := range roles {
+		rp := ag.RolePolicies[rolearn]
+		// managed policies, if they are part of the trace:
+		for _, policy := range rp.Managed {
+			if pnode, ok := policies[*policy.PolicyArn]; ok {
+				g.Edge(node, pnode)
+			}
+		}
+		// inline policies are embedded in the role so we always draw them,
+		// keyed by the role ARN since roles in different accounts can have
+		// the same name:
+		for _, name := range rp.Inline {
+			inode := formatAsInlinePolicy(g.Node(fmt.Sprintf("%v/%v", rolearn, name)).Label(fmt.Sprintf("%v/%v", *ag.Roles[rolearn].RoleName, name)))
+			g.Edge(node, inode)
+		}
+	}
+
+	// principals -> IAM roles, based on the trust policy of the role:
+	for rolearn, node := range roles {
+		role, ok := ag.Roles[rolearn]
+		if !ok {
+			continue
+		}
+		trs, err := roleTrust(role)
+		if err != nil {
+			continue
+		}
+		for _, tr := range trs {
+			if tr.Effect != "Allow" {
+				continue
+			}
+			// if the principal is a role that is part of the trace, we use it,
+			// and roles of other accounts we collected show up as roles, too:
+			pnode, ok := roles[tr.Principal]
+			_, known := ag.Roles[tr.Principal]
+			switch {
+			case ok:
+			case known && tr.CrossAccount:
+				pnode = formatAsRole(g.Node(tr.Principal))
+			default:
+				pnode = formatAsPrincipal(g.Node(fmt.Sprintf("%v: %v", tr.PrincipalType, tr.Principal)))
+			}
+			e := g.Edge(pnode, node, "can assume").Attr("fontname", "Helvetica")
+			if tr.CrossAccount {
+				e.Attr("label", "can assume (cross-account)").Attr("color", "darkorange")
+			}
+		}
+	}
 
 	// now we can write out the graph into a file in DOT format:
 	filename := fmt.Sprintf("rbiam-trace-%v.dot", time.Now().Unix())
@@ -203,6 +430,22 @@ func formatAsPolicy(n dot.Node) dot.Node {
 	return n.Attr("style", "filled").Attr("fillcolor", "#D9A7F1").Attr("fontcolor", "#000000").Attr("fontname", "Helvetica")
 }
 
+func formatAsInlinePolicy(n dot.Node) dot.Node {
+	return formatAsPolicy(n).Attr("style", "filled,dashed")
+}
+
+func formatAsPrincipal(n dot.Node) dot.Node {
+	return n.Attr("style", "filled").Attr("fillcolor", "#C0C0C0").Attr("fontcolor", "#000000").Attr("fontname", "Helvetica")
+}
+
+func formatAsKubeRole(n dot.Node) dot.Node {
+	return n.Attr("style", "filled").Attr("fillcolor", "#8FB4FF").Attr("fontcolor", "#000000").Attr("fontname", "Helvetica")
+}
+
+func formatAsSubject(n dot.Node) dot.Node {
+	return n.Attr("style", "filled").Attr("fillcolor", "#E0E0E0").Attr("fontcolor", "#000000").Attr("fontname", "Helvetica")
+}
+
 func formatAsServiceAccount(n dot.Node) dot.Node {
 	return n.Attr("style", "filled").Attr("fillcolor", "#1BFF9F").Attr("fontcolor", "#000000").Attr("fontname", "Helvetica")
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// inTempDir runs the test in a temporary working directory, since exports
+// are written to the current working directory.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("can't get working directory: %v", err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatalf("can't change working directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestExportGraphInlinePoliciesPerAccount(t *testing.T) {
+	ag := fixtureGraph(t)
+	rolearn, otherarn := "arn:aws:iam::123456789012:role/s3-echoer", "arn:aws:iam::210987654321:role/s3-echoer"
+	// a role with the same name and inline policy in another account:
+	other := ag.Roles[rolearn]
+	other.Arn = aws.String(otherarn)
+	ag.Roles[otherarn] = other
+	ag.RolePolicies[otherarn] = RolePolicies{Inline: ag.RolePolicies[rolearn].Inline}
+	inTempDir(t)
+	fn, err := exportGraph([]string{histitem("IAM role", rolearn), histitem("IAM role", otherarn)}, ag)
+	if err != nil {
+		t.Fatalf("can't export graph: %v", err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("can't read export: %v", err)
+	}
+	if n := strings.Count(string(b), `label="s3-echoer/echoer-logs"`); n != 2 {
+		t.Errorf("got %v inline policy nodes echoer-logs, want one per account:\n%s", n, b)
+	}
+}
+
+func TestExportGraphServiceAccountsWithoutSecrets(t *testing.T) {
+	ag := fixtureGraph(t)
+	inTempDir(t)
+	edges := func(trace []string) int {
+		fn, err := exportGraph(trace, ag)
+		if err != nil {
+			t.Fatalf("can't export graph: %v", err)
+		}
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("can't read export: %v", err)
+		}
+		os.Remove(fn)
+		return strings.Count(string(b), "->")
+	}
+	// apps:upload-images has no token secrets, like most service accounts
+	// since Kubernetes 1.24:
+	trace := []string{
+		histitem("Kubernetes service account", "apps:upload-images"),
+		histitem("Kubernetes service account", "default:s3-echoer"),
+	}
+	without := edges(trace)
+	with := edges(append(trace, histitem("Kubernetes secret", "default:s3-echoer-token-fghij")))
+	if with != without+1 {
+		t.Errorf("got %v edges with the secret and %v without, want one from default:s3-echoer to it", with, without)
+	}
+}
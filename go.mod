@@ -0,0 +1,2 @@
+require github.com/mhausenblas/kubecuddler v0.0.0
+replace github.com/mhausenblas/kubecuddler => /tmp/kc
@@ -3,29 +3,216 @@ package main
 import (
 	"context"
 	"fmt"
-	"net/url"
+	"sort"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
-// user queries IAM to retrieve info on the user issuing the request.
-func (ag *AccessGraph) user(cfg aws.Config) error {
-	svc := iam.New(cfg)
+// awsSource is the live IAM source, querying IAM, STS and EC2 with the
+// credentials and region of the AWS config cfg.
+type awsSource struct {
+	cfg aws.Config
+}
+
+// CallerIdentity queries STS to retrieve the identity of the caller.
+func (src awsSource) CallerIdentity() (*sts.GetCallerIdentityOutput, error) {
+	svc := sts.New(src.cfg)
+	req := svc.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	return req.Send(context.Background())
+}
+
+// User queries IAM to retrieve info on the user issuing the request.
+func (src awsSource) User() (*iam.User, error) {
+	svc := iam.New(src.cfg)
 	req := svc.GetUserRequest(&iam.GetUserInput{})
 	res, err := req.Send(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return res.User, nil
+}
+
+// Roles queries IAM for all roles. The listing is paginated, that is,
+// we keep following the marker until IAM tells us there are no more results.
+func (src awsSource) Roles() ([]iam.Role, error) {
+	svc := iam.New(src.cfg)
+	roles := []iam.Role{}
+	var marker *string
+	for {
+		req := svc.ListRolesRequest(&iam.ListRolesInput{Marker: marker})
+		res, err := req.Send(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, res.Roles...)
+		if res.IsTruncated == nil || !*res.IsTruncated {
+			break
+		}
+		marker = res.Marker
+	}
+	return roles, nil
+}
+
+// RolePolicies queries IAM for the managed and inline policies attached to
+// the role, following the marker until all pages have been retrieved.
+func (src awsSource) RolePolicies(role iam.Role) (RolePolicies, error) {
+	svc := iam.New(src.cfg)
+	rp := RolePolicies{}
+	var marker *string
+	for {
+		req := svc.ListAttachedRolePoliciesRequest(&iam.ListAttachedRolePoliciesInput{
+			RoleName: role.RoleName,
+			Marker:   marker,
+		})
+		res, err := req.Send(context.TODO())
+		if err != nil {
+			return rp, err
+		}
+		rp.Managed = append(rp.Managed, res.AttachedPolicies...)
+		if res.IsTruncated == nil || !*res.IsTruncated {
+			break
+		}
+		marker = res.Marker
+	}
+	marker = nil
+	for {
+		req := svc.ListRolePoliciesRequest(&iam.ListRolePoliciesInput{
+			RoleName: role.RoleName,
+			Marker:   marker,
+		})
+		res, err := req.Send(context.TODO())
+		if err != nil {
+			return rp, err
+		}
+		rp.Inline = append(rp.Inline, res.PolicyNames...)
+		if res.IsTruncated == nil || !*res.IsTruncated {
+			break
+		}
+		marker = res.Marker
+	}
+	return rp, nil
+}
+
+// Policies queries IAM for attached policies, following the marker
+// until all pages have been retrieved.
+func (src awsSource) Policies() ([]iam.Policy, error) {
+	svc := iam.New(src.cfg)
+	policies := []iam.Policy{}
+	var marker *string
+	for {
+		req := svc.ListPoliciesRequest(&iam.ListPoliciesInput{
+			OnlyAttached: aws.Bool(true),
+			Marker:       marker,
+		})
+		res, err := req.Send(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, res.Policies...)
+		if res.IsTruncated == nil || !*res.IsTruncated {
+			break
+		}
+		marker = res.Marker
+	}
+	return policies, nil
+}
+
+// PolicyDocument queries IAM for the document of the default version of
+// the policy.
+func (src awsSource) PolicyDocument(policy iam.Policy) (*PolicyDocument, error) {
+	svc := iam.New(src.cfg)
+	versionid := policy.DefaultVersionId
+	if versionid == nil {
+		req := svc.GetPolicyRequest(&iam.GetPolicyInput{PolicyArn: policy.Arn})
+		res, err := req.Send(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		versionid = res.Policy.DefaultVersionId
+	}
+	req := svc.GetPolicyVersionRequest(&iam.GetPolicyVersionInput{
+		PolicyArn: policy.Arn,
+		VersionId: versionid,
+	})
+	res, err := req.Send(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return parsePolicyDocument(*res.PolicyVersion.Document)
+}
+
+// InstanceProfiles queries IAM for the instance profiles, following the
+// marker until all pages have been retrieved.
+func (src awsSource) InstanceProfiles() ([]iam.InstanceProfile, error) {
+	svc := iam.New(src.cfg)
+	profiles := []iam.InstanceProfile{}
+	var marker *string
+	for {
+		req := svc.ListInstanceProfilesRequest(&iam.ListInstanceProfilesInput{Marker: marker})
+		res, err := req.Send(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, res.InstanceProfiles...)
+		if res.IsTruncated == nil || !*res.IsTruncated {
+			break
+		}
+		marker = res.Marker
+	}
+	return profiles, nil
+}
+
+// user retrieves info on the user issuing the request, which only works
+// if the caller is an IAM user, see also callerKind().
+func (ag *AccessGraph) user(src IAMSource) error {
+	user, err := src.User()
 	if err != nil {
 		return err
 	}
-	ag.User = res.User
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	ag.User = user
 	return nil
 }
 
-// formatCaller provides a textual rendering of the combined IAM user and caller information.
+// formatCaller provides a textual rendering of the combined IAM user and
+// caller information. For callers that are not IAM users, for example when
+// using AWS SSO or an assumed role, we show the role instead.
 func formatCaller(ag *AccessGraph) string {
 	user := ag.User
 	caller := ag.Caller
+	if user == nil {
+		kind, _, session := callerKind(*caller.Arn)
+		if session == "" {
+			session = "n/a"
+		}
+		role, kubeidentity := "n/a", "n/a"
+		if rolearn, ok := ag.callerRoleARN(); ok {
+			role = rolearn
+			if ag.isSSORole(rolearn) {
+				role += " (AWS SSO)"
+			}
+			kubeidentity = formatRoleMappings(ag.roleMappings(rolearn))
+		}
+		return fmt.Sprintf(
+			"     Account ID: %v\n"+
+				"     Caller ARN: %v\n"+
+				"     Caller ID: %v\n"+
+				"     Caller type: %v\n"+
+				"     Role: %v\n"+
+				"     Session name: %v\n"+
+				"     Kubernetes identity (aws-auth): %v\n",
+			*caller.Account,
+			*caller.Arn,
+			*caller.UserId,
+			kind,
+			role,
+			session,
+			kubeidentity,
+		)
+	}
 	return fmt.Sprintf(
 		"     Account ID: %v\n"+
 			"     User name: %v\n"+
@@ -33,7 +220,8 @@ func formatCaller(ag *AccessGraph) string {
 			"     Caller ID: %v\n"+
 			"     Path: %v\n"+
 			"     Created at: %v\n"+
-			"     Tags: %v\n",
+			"     Tags: %v\n"+
+			"     Kubernetes identity (aws-auth): %v\n",
 		*caller.Account,
 		*user.UserName,
 		*user.UserId,
@@ -41,93 +229,255 @@ func formatCaller(ag *AccessGraph) string {
 		*user.Path,
 		user.CreateDate,
 		user.Tags,
+		formatUserMappings(ag.userMappings(*user.Arn)),
 	)
 }
 
-// callerIdentity queries STS to retrieve the identity of the caller.
-func (ag *AccessGraph) callerIdentity(cfg aws.Config) error {
-	svc := sts.New(cfg)
-	req := svc.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
-	res, err := req.Send(context.Background())
+// roles retrieves all IAM roles, keyed by role ARN.
+func (ag *AccessGraph) roles(src IAMSource) error {
+	roles, err := src.Roles()
 	if err != nil {
 		return err
 	}
-	ag.Caller = res
-	return nil
-}
-
-// roles queries IAM for roles in use, related to EKS.
-// This is done simply by checking if the role ARN contains EKS or eks.
-func (ag *AccessGraph) roles(cfg aws.Config) error {
-	svc := iam.New(cfg)
-	req := svc.ListRolesRequest(&iam.ListRolesInput{})
-	res, err := req.Send(context.TODO())
-	if err != nil {
-		return err
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.Roles == nil {
+		ag.Roles = make(map[string]iam.Role)
 	}
-	ag.Roles = make(map[string]iam.Role)
-	for _, role := range res.Roles {
+	for _, role := range roles {
 		rolearn := *role.Arn
 		ag.Roles[rolearn] = role
 	}
 	return nil
 }
 
-// formatRole provides a textual rendering of a role
-func formatRole(role *iam.Role) string {
-	arpd := ""
-	u, err := url.QueryUnescape(*role.AssumeRolePolicyDocument)
+// RolePolicies captures the policies attached to an IAM role, that is,
+// the managed policies as well as the names of the inline policies.
+type RolePolicies struct {
+	// Managed is the collection of managed policies attached to the role.
+	Managed []iam.AttachedPolicy
+	// Inline is the collection of names of inline policies embedded in the role.
+	Inline []string
+}
+
+// rolePolicies retrieves the managed and inline policies attached to
+// each of the roles in the account src gives access to, so needs to be
+// called after roles(). Roles whose policies are already known are
+// skipped. IAM doesn't tell us when policies have been attached to,
+// detached from or embedded in a role, so we always re-fetch them, also
+// when refreshing. The roles are queried concurrently, as far as src allows.
+func (ag *AccessGraph) rolePolicies(src IAMSource, account string) error {
+	ag.mu.Lock()
+	if ag.RolePolicies == nil {
+		ag.RolePolicies = make(map[string]RolePolicies)
+	}
+	roles := []iam.Role{}
+	for rolearn, role := range ag.Roles {
+		if _, ok := ag.RolePolicies[rolearn]; ok || arnAccount(rolearn) != account {
+			continue
+		}
+		roles = append(roles, role)
+	}
+	ag.mu.Unlock()
+	err := parallel(len(roles), func(i int) error {
+		rp, err := src.RolePolicies(roles[i])
+		if err != nil {
+			return err
+		}
+		ag.mu.Lock()
+		defer ag.mu.Unlock()
+		ag.RolePolicies[*roles[i].Arn] = rp
+		return nil
+	})
+	return err
+}
+
+// formatRole provides a textual rendering of a role along with the
+// policies attached to it, the service accounts using it via IRSA and
+// the Kubernetes user and groups it maps to.
+func formatRole(ag *AccessGraph, role *iam.Role) string {
+	rp := ag.RolePolicies[*role.Arn]
+	trusted := ""
+	trs, err := roleTrust(*role)
 	if err == nil {
-		arpd = u
+		trusted = formatTrustRelationships(trs)
+	}
+	managed := ""
+	for _, policy := range rp.Managed {
+		managed += fmt.Sprintf("\n      %v", *policy.PolicyArn)
+	}
+	inline := ""
+	for _, name := range rp.Inline {
+		inline += fmt.Sprintf("\n      %v", name)
 	}
 	return fmt.Sprintf(
 		"     Name: %v\n"+
 			"     ID: %v\n"+
 			"     Path: %v\n"+
 			"     Assume role by: %v\n"+
+			"     Managed policies: %v\n"+
+			"     Inline policies: %v\n"+
+			"     Service accounts (IRSA): %v\n"+
+			"     Kubernetes identity (aws-auth): %v\n"+
 			"     Maximum session duration: %v sec\n"+
 			"     Created at: %v\n"+
 			"     Tags: %v\n",
 		*role.RoleName,
 		*role.RoleId,
 		*role.Path,
-		arpd,
+		trusted,
+		managed,
+		inline,
+		formatIRSALinks(ag.irsaLinksOf(*role.Arn), false),
+		formatRoleMappings(ag.roleMappings(*role.Arn)),
 		*role.MaxSessionDuration,
 		role.CreateDate,
 		role.Tags,
 	)
 }
 
-// policies queries IAM for attached policies
-func (ag *AccessGraph) policies(cfg aws.Config) error {
-	svc := iam.New(cfg)
-	req := svc.ListPoliciesRequest(&iam.ListPoliciesInput{OnlyAttached: aws.Bool(true)})
-	res, err := req.Send(context.TODO())
+// policies retrieves the attached IAM policies of the account src gives
+// access to, keyed by policy ARN, and records their attachment count in the
+// account.
+func (ag *AccessGraph) policies(src IAMSource, account string) error {
+	policies, err := src.Policies()
 	if err != nil {
 		return err
 	}
-	ag.Policies = make(map[string]iam.Policy)
-	for _, policy := range res.Policies {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.Policies == nil {
+		ag.Policies = make(map[string]iam.Policy)
+	}
+	if ag.PolicyAttachments == nil {
+		ag.PolicyAttachments = make(map[string]map[string]int64)
+	}
+	for _, policy := range policies {
 		policyarn := *policy.Arn
 		ag.Policies[policyarn] = policy
+		if ag.PolicyAttachments[policyarn] == nil {
+			ag.PolicyAttachments[policyarn] = make(map[string]int64)
+		}
+		ag.PolicyAttachments[policyarn][account] = aws.Int64Value(policy.AttachmentCount)
 	}
 	return nil
 }
 
-// formatPolicy provides a textual rendering of a policy.
-func formatPolicy(policy *iam.Policy) string {
+// policyDocuments retrieves the document of the default version of each
+// of the policies of the account src gives access to, including the AWS
+// managed ones, so needs to be called after policies(). Policies whose
+// document is already known, for example AWS managed policies attached in
+// another account, are skipped, and when refreshing we reuse the documents
+// of policies whose default version didn't change. Documents we can't parse
+// are recorded in PolicyDocumentErrors and skipped, rather than failing the
+// collector, and so are documents we can't get, for example because access
+// to a single policy is denied, which only fails the collector after all
+// the other documents have been fetched. The policies are queried
+// concurrently, as far as src allows.
+func (ag *AccessGraph) policyDocuments(src IAMSource, account string) error {
+	ag.mu.Lock()
+	if ag.PolicyDocuments == nil {
+		ag.PolicyDocuments = make(map[string]PolicyDocument)
+	}
+	if ag.PolicyDocumentErrors == nil {
+		ag.PolicyDocumentErrors = make(map[string]string)
+	}
+	policies := []iam.Policy{}
+	for policyarn, policy := range ag.Policies {
+		if _, ok := ag.PolicyDocuments[policyarn]; ok {
+			continue
+		}
+		if owner := arnAccount(policyarn); owner != account && owner != "aws" {
+			continue
+		}
+		if ag.prev != nil {
+			pd, ok := ag.prev.PolicyDocuments[policyarn]
+			if ok && policyVersion(ag.prev.Policies[policyarn]) == policyVersion(policy) {
+				ag.PolicyDocuments[policyarn] = pd
+				continue
+			}
+		}
+		policies = append(policies, policy)
+	}
+	ag.mu.Unlock()
+	err := parallel(len(policies), func(i int) error {
+		policyarn := *policies[i].Arn
+		pd, err := src.PolicyDocument(policies[i])
+		if perr, ok := err.(*PolicyParseError); ok {
+			ag.mu.Lock()
+			defer ag.mu.Unlock()
+			ag.PolicyDocumentErrors[policyarn] = perr.Error()
+			return nil
+		}
+		if err != nil {
+			ag.mu.Lock()
+			defer ag.mu.Unlock()
+			ag.PolicyDocumentErrors[policyarn] = fmt.Sprintf("can't get policy document: %v", err)
+			return fmt.Errorf("can't get document of %v: %v", policyarn, err)
+		}
+		ag.mu.Lock()
+		defer ag.mu.Unlock()
+		ag.PolicyDocuments[policyarn] = *pd
+		return nil
+	})
+	return err
+}
+
+// formatPolicy provides a textual rendering of a policy, including the
+// number of entities it's attached to, per account if there are several,
+// and the statements of its default version or, if the document couldn't
+// be parsed, why.
+func formatPolicy(policy *iam.Policy, attachments map[string]int64, pd *PolicyDocument, docerr string) string {
+	attached := fmt.Sprintf("%v", aws.Int64Value(policy.AttachmentCount))
+	if len(attachments) > 1 {
+		accounts := []string{}
+		for account := range attachments {
+			accounts = append(accounts, account)
+		}
+		sort.Strings(accounts)
+		attached = ""
+		for _, account := range accounts {
+			attached += fmt.Sprintf("\n      %v: %v", account, attachments[account])
+		}
+	}
+	statements := formatStatements(pd)
+	if docerr != "" {
+		statements = fmt.Sprintf("      n/a, %v\n", docerr)
+	}
 	return fmt.Sprintf(
 		"     Name: %v\n"+
 			"     ID: %v\n"+
 			"     Path: %v\n"+
 			"     Number of entities the policy is attached: %v\n"+
+			"     Default version: %v\n"+
 			"     Created at: %v\n"+
-			"     Updated at: %v\n",
+			"     Updated at: %v\n"+
+			"     Statements:\n%v",
 		*policy.PolicyName,
 		*policy.PolicyId,
 		*policy.Path,
-		*policy.AttachmentCount,
+		attached,
+		aws.StringValue(policy.DefaultVersionId),
 		*policy.CreateDate,
 		*policy.UpdateDate,
+		statements,
 	)
 }
+
+// instanceProfiles retrieves the IAM instance profiles, keyed by ARN.
+func (ag *AccessGraph) instanceProfiles(src IAMSource) error {
+	profiles, err := src.InstanceProfiles()
+	if err != nil {
+		return err
+	}
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.InstanceProfiles == nil {
+		ag.InstanceProfiles = make(map[string]iam.InstanceProfile)
+	}
+	for _, profile := range profiles {
+		profilearn := *profile.Arn
+		ag.InstanceProfiles[profilearn] = profile
+	}
+	return nil
+}
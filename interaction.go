@@ -1,24 +1,33 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/c-bata/go-prompt"
 )
 
 // toplevel represents the top level choices in the interaction.
 func toplevel(d prompt.Document) []prompt.Suggest {
 	s := []prompt.Suggest{
-		{Text: "iam-user", Description: "Describe calling AWS IAM user"},
+		{Text: "iam-user", Description: "Describe calling AWS identity"},
 		{Text: "iam-roles", Description: "Select an AWS IAM role to explore"},
 		{Text: "iam-policies", Description: "Select an AWS IAM policy to explore"},
 		{Text: "k8s-sa", Description: "Select an Kubernetes service account to explore"},
 		{Text: "k8s-secrets", Description: "Select a Kubernetes secret to explore"},
+		{Text: "k8s-reveal", Description: "Select a Kubernetes secret and key to show its value"},
 		{Text: "k8s-pods", Description: "Select a Kubernetes pod to explore"},
+		{Text: "k8s-roles", Description: "Select a Kubernetes role or cluster role to explore"},
+		{Text: "k8s-bindings", Description: "Select a Kubernetes role binding or cluster role binding to explore"},
+		{Text: "output", Description: "Set the output format of query commands"},
 		{Text: "history", Description: "Show the history of selected items"},
-		{Text: "sync", Description: "Synchronize the local state with IAM and Kubernetes"},
+		{Text: "sync", Description: "Re-list IAM and Kubernetes info, reusing unchanged policy documents"},
+		{Text: "status", Description: "Show which info could be collected from IAM and Kubernetes"},
 		{Text: "trace", Description: "Start tracing"},
 		{Text: "export-raw", Description: "Stop tracing and export trace to JSON dump in current working directory"},
 		{Text: "export-graph", Description: "Stop tracing and export trace as DOT file in current working directory"},
 		{Text: "dump", Description: "Export access graph as a JSON dump in current working directory"},
+		{Text: "diff", Description: "Compare a dump with the current access graph, or two dumps"},
+		{Text: "snapshots", Description: "List the dumps in the snapshot directory"},
 		{Text: "help", Description: "Explain how it works and show available commands"},
 		{Text: "quit", Description: "Terminate the interactive session and quit"},
 	}
@@ -61,6 +70,18 @@ func selectSecret(d prompt.Document) []prompt.Suggest {
 	return prompt.FilterContains(s, d.GetWordBeforeCursor(), true)
 }
 
+// selectSecretKey allows user to select a key of the Kubernetes secret
+// with the given key.
+func selectSecretKey(seckey string) prompt.Completer {
+	return func(d prompt.Document) []prompt.Suggest {
+		s := []prompt.Suggest{}
+		for _, k := range secretKeys(ag.Secrets[seckey]) {
+			s = append(s, prompt.Suggest{Text: k})
+		}
+		return prompt.FilterHasPrefix(s, d.GetWordBeforeCursor(), true)
+	}
+}
+
 // selectPod allows user to select a Kubernetes pod.
 func selectPod(d prompt.Document) []prompt.Suggest {
 	s := []prompt.Suggest{}
@@ -69,3 +90,67 @@ func selectPod(d prompt.Document) []prompt.Suggest {
 	}
 	return prompt.FilterContains(s, d.GetWordBeforeCursor(), true)
 }
+
+// kubeRoleKinds and kubeBindingKinds map the kinds the k8s-roles and
+// k8s-bindings suggestions are prefixed with to the respective item types.
+// The prefix tells apart roles and cluster roles with the same key, for
+// example the role controller:x in namespace system and the cluster role
+// system:controller:x, and likewise for bindings.
+var (
+	kubeRoleKinds    = map[string]string{"Role": "Kubernetes role", "ClusterRole": "Kubernetes cluster role"}
+	kubeBindingKinds = map[string]string{"RoleBinding": "Kubernetes role binding", "ClusterRoleBinding": "Kubernetes cluster role binding"}
+)
+
+// selectKubeRole allows user to select a Kubernetes role or cluster role,
+// as in Role/NAMESPACE:NAME or ClusterRole/NAME.
+func selectKubeRole(d prompt.Document) []prompt.Suggest {
+	s := []prompt.Suggest{}
+	for rolename := range ag.KubeRoles {
+		s = append(s, prompt.Suggest{Text: "Role/" + rolename})
+	}
+	for crolename := range ag.KubeClusterRoles {
+		s = append(s, prompt.Suggest{Text: "ClusterRole/" + crolename})
+	}
+	return prompt.FilterContains(s, d.GetWordBeforeCursor(), true)
+}
+
+// selectKubeBinding allows user to select a Kubernetes role binding or
+// cluster role binding, as in RoleBinding/NAMESPACE:NAME or
+// ClusterRoleBinding/NAME.
+func selectKubeBinding(d prompt.Document) []prompt.Suggest {
+	s := []prompt.Suggest{}
+	for rbname := range ag.KubeRoleBindings {
+		s = append(s, prompt.Suggest{Text: "RoleBinding/" + rbname})
+	}
+	for crbname := range ag.KubeClusterRoleBindings {
+		s = append(s, prompt.Suggest{Text: "ClusterRoleBinding/" + crbname})
+	}
+	return prompt.FilterContains(s, d.GetWordBeforeCursor(), true)
+}
+
+// selectedKind resolves a kind-prefixed selection, such as ClusterRole/NAME,
+// to the item type and key, using kinds to map the kind to the item type.
+// It returns false if the kind is unknown or the item doesn't exist.
+func selectedKind(ag *AccessGraph, kinds map[string]string, selection string) (itype, ikey string, ok bool) {
+	kindkey := strings.SplitN(selection, "/", 2)
+	if len(kindkey) != 2 {
+		return "", "", false
+	}
+	itype, ok = kinds[kindkey[0]]
+	if !ok {
+		return "", "", false
+	}
+	if _, ok := entity(ag, itype, kindkey[1]); !ok {
+		return "", "", false
+	}
+	return itype, kindkey[1], true
+}
+
+// selectOutputFormat allows user to select an output format.
+func selectOutputFormat(d prompt.Document) []prompt.Suggest {
+	s := []prompt.Suggest{}
+	for _, of := range outputFormats {
+		s = append(s, prompt.Suggest{Text: string(of)})
+	}
+	return prompt.FilterHasPrefix(s, d.GetWordBeforeCursor(), true)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelectedKind(t *testing.T) {
+	ag := fixtureGraph(t)
+	// a role whose key collides with the name of a cluster role:
+	ag.KubeRoles["system:controller:x"] = Role{ObjectMeta: ObjectMeta{Namespace: "system", Name: "controller:x"}}
+	ag.KubeClusterRoles["system:controller:x"] = ClusterRole{ObjectMeta: ObjectMeta{Name: "system:controller:x"}}
+	tests := []struct {
+		selection, itype, ikey string
+		ok                     bool
+	}{
+		{"Role/system:controller:x", "Kubernetes role", "system:controller:x", true},
+		{"ClusterRole/system:controller:x", "Kubernetes cluster role", "system:controller:x", true},
+		{"Role/default:pod-reader", "Kubernetes role", "default:pod-reader", true},
+		{"ClusterRole/default:pod-reader", "", "", false},
+		{"default:pod-reader", "", "", false},
+		{"RoleBinding/default:read-pods", "", "", false},
+	}
+	for _, tt := range tests {
+		itype, ikey, ok := selectedKind(ag, kubeRoleKinds, tt.selection)
+		if itype != tt.itype || ikey != tt.ikey || ok != tt.ok {
+			t.Errorf("got %q, %q, %v for %v, want %q, %q, %v", itype, ikey, ok, tt.selection, tt.itype, tt.ikey, tt.ok)
+		}
+	}
+	itype, ikey, ok := selectedKind(ag, kubeBindingKinds, "ClusterRoleBinding/viewers")
+	if itype != "Kubernetes cluster role binding" || ikey != "viewers" || !ok {
+		t.Errorf("got %q, %q, %v for ClusterRoleBinding/viewers", itype, ikey, ok)
+	}
+}
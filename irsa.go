@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// irsaAnnotation is the service account annotation that IAM roles for
+// service accounts (IRSA) uses to point to the IAM role to assume, see also:
+// https://docs.aws.amazon.com/eks/latest/userguide/iam-roles-for-service-accounts.html
+const irsaAnnotation = "eks.amazonaws.com/role-arn"
+
+// irsaSubjectPrefix is the prefix of the subject of the OIDC tokens issued
+// to service accounts, completed by namespace and name.
+const irsaSubjectPrefix = "system:serviceaccount:"
+
+// IRSALink represents the relationship between a Kubernetes service account
+// and an IAM role, established via IRSA.
+type IRSALink struct {
+	// ServiceAccount is the key of the service account, that is, its
+	// namespaced name, prefixed by the cluster if there are several.
+	ServiceAccount string
+	// Role is the ARN of the IAM role.
+	Role string
+	// Annotated is true if the service account annotation points to the role.
+	Annotated bool
+	// Trusted is true if the trust policy of the role allows the service
+	// account to assume the role.
+	Trusted bool
+	// TrustsAll is true if the trust policy of the role doesn't restrict
+	// the subject, for example with only an :aud condition, so that any
+	// service account of the cluster can assume the role.
+	TrustsAll bool `json:",omitempty"`
+}
+
+// mismatch is true if the service account annotation points to a role
+// whose trust policy doesn't allow the service account to assume it.
+func (l IRSALink) mismatch() bool {
+	return l.Annotated && !l.Trusted
+}
+
+// irsaLinks returns the links between service accounts and IAM roles, see
+// computeIRSALinks(). They're computed once per access graph, on first use,
+// since the access graph doesn't change once collected or loaded.
+func (ag *AccessGraph) irsaLinks() []IRSALink {
+	ag.irsaOnce.Do(func() {
+		ag.irsa = ag.computeIRSALinks()
+		ag.irsaIndex = make(map[string][]IRSALink)
+		for _, l := range ag.irsa {
+			ag.irsaIndex[l.ServiceAccount] = append(ag.irsaIndex[l.ServiceAccount], l)
+			ag.irsaIndex[l.Role] = append(ag.irsaIndex[l.Role], l)
+		}
+	})
+	return ag.irsa
+}
+
+// computeIRSALinks computes the links between service accounts and IAM roles,
+// based on the eks.amazonaws.com/role-arn annotation of service accounts on
+// the one hand and the system:serviceaccount:NAMESPACE:NAME subject conditions
+// in the OIDC trust policy of roles on the other hand. Roles whose OIDC trust
+// doesn't restrict the subject trust all service accounts, which we only
+// record for the service accounts annotated with the role, rather than
+// linking every service account. With several clusters, a role is linked to
+// the service accounts of each cluster whose OIDC provider it trusts, so
+// roles shared between clusters show up in all of them.
+func (ag *AccessGraph) computeIRSALinks() []IRSALink {
+	links := make(map[string]*IRSALink)
+	link := func(sa, role string) *IRSALink {
+		k := sa + " " + role
+		if _, ok := links[k]; !ok {
+			links[k] = &IRSALink{ServiceAccount: sa, Role: role}
+		}
+		return links[k]
+	}
+	// roles trusting all service accounts of a cluster, keyed by role ARN
+	// and cluster name:
+	trustsall := make(map[string]bool)
+	// roles -> service accounts, via trust policies:
+	for rolearn, role := range ag.Roles {
+		trs, err := trustRelationships(*role.AssumeRolePolicyDocument)
+		if err != nil {
+			continue
+		}
+		for _, tr := range trs {
+			if tr.Effect != "Allow" || tr.PrincipalType != "Federated" {
+				continue
+			}
+			restricted := false
+			for op, kv := range tr.Condition {
+				for k, subjects := range kv {
+					if !strings.HasSuffix(k, ":sub") {
+						continue
+					}
+					for _, subject := range subjects {
+						if op == "StringLike" && strings.Trim(subject, "*") == "" {
+							continue
+						}
+						restricted = true
+						switch op {
+						case "StringEquals":
+							if !strings.HasPrefix(subject, irsaSubjectPrefix) {
+								continue
+							}
+							ns, name := splitSubject(subject)
+							for _, cluster := range ag.clusters() {
+								if ag.trustsCluster(tr.Principal, cluster) {
+									link(kubekey(cluster, ns, name), rolearn).Trusted = true
+								}
+							}
+						case "StringLike":
+							for sakey, sa := range ag.ServiceAccounts {
+								if !ag.trustsCluster(tr.Principal, sa.ClusterName) {
+									continue
+								}
+								if stringLike(subject, irsaSubjectPrefix+namespaceit(sa.Namespace, sa.Name)) {
+									link(sakey, rolearn).Trusted = true
+								}
+							}
+						}
+					}
+				}
+			}
+			if !restricted && strings.Contains(tr.Principal, ":oidc-provider/") {
+				for _, cluster := range ag.clusters() {
+					if ag.trustsCluster(tr.Principal, cluster) {
+						trustsall[rolearn+" "+cluster] = true
+					}
+				}
+			}
+		}
+	}
+	// service accounts -> roles, via annotations:
+	for sakey, sa := range ag.ServiceAccounts {
+		if rolearn, ok := sa.Annotations[irsaAnnotation]; ok {
+			l := link(sakey, rolearn)
+			l.Annotated = true
+			if trustsall[rolearn+" "+sa.ClusterName] {
+				l.Trusted = true
+				l.TrustsAll = true
+			}
+		}
+	}
+	res := []IRSALink{}
+	for _, l := range links {
+		res = append(res, *l)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].ServiceAccount != res[j].ServiceAccount {
+			return res[i].ServiceAccount < res[j].ServiceAccount
+		}
+		return res[i].Role < res[j].Role
+	})
+	return res
+}
+
+// irsaLinksOf returns the IRSA links of the service account or role with
+// the given key, that is, the service account key or the role ARN respectively.
+func (ag *AccessGraph) irsaLinksOf(key string) []IRSALink {
+	ag.irsaLinks()
+	return append([]IRSALink{}, ag.irsaIndex[key]...)
+}
+
+// stringLike matches s against the pattern of a StringLike condition, in
+// which * matches any sequence of characters, including none, and ? any
+// single character. Unlike with path.Match, all other characters, such as
+// '[' or '\', match themselves, as they do in IAM.
+func stringLike(pattern, s string) bool {
+	p, str := []rune(pattern), []rune(s)
+	pi, si := 0, 0
+	// the position of the last * in the pattern and the position in s it
+	// has been matched up to, for backtracking:
+	star, matched := -1, 0
+	for si < len(str) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == str[si]):
+			pi++
+			si++
+		case pi < len(p) && p[pi] == '*':
+			star, matched = pi, si
+			pi++
+		case star >= 0:
+			matched++
+			pi, si = star+1, matched
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// splitSubject takes an OIDC subject in the form of
+// system:serviceaccount:NAMESPACE:NAME and returns namespace and name.
+func splitSubject(subject string) (ns, name string) {
+	nsname := strings.SplitN(strings.TrimPrefix(subject, irsaSubjectPrefix), ":", 2)
+	if len(nsname) != 2 {
+		return "", nsname[0]
+	}
+	return nsname[0], nsname[1]
+}
+
+// formatIRSALinks provides a textual rendering of IRSA links from the
+// point of view of a service account (showing the role) or a role
+// (showing the service account).
+func formatIRSALinks(links []IRSALink, showrole bool) string {
+	if len(links) == 0 {
+		return "\n      n/a"
+	}
+	var b strings.Builder
+	for _, l := range links {
+		target := l.ServiceAccount
+		if showrole {
+			target = l.Role
+		}
+		status := "annotated and trusted"
+		switch {
+		case l.TrustsAll:
+			status = "annotated, role trusts all service accounts"
+		case l.mismatch():
+			status = "MISMATCH: annotated but trust policy doesn't allow service account"
+		case !l.Annotated:
+			status = "trusted but not annotated"
+		}
+		b.WriteString(fmt.Sprintf("\n      %v (%v)", target, status))
+	}
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStringLike(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"system:serviceaccount:default:s3-echoer", "system:serviceaccount:default:s3-echoer", true},
+		{"system:serviceaccount:default:*", "system:serviceaccount:default:s3-echoer", true},
+		{"system:serviceaccount:default:*", "system:serviceaccount:apps:s3-echoer", false},
+		{"system:serviceaccount:*:s3-*", "system:serviceaccount:apps:s3-echoer", true},
+		{"system:serviceaccount:*", "system:serviceaccount:", true},
+		{"system:serviceaccount:default:s3-echoer?", "system:serviceaccount:default:s3-echoer1", true},
+		{"system:serviceaccount:default:s3-echoer?", "system:serviceaccount:default:s3-echoer", false},
+		{"*:*:*-[ab]", "system:serviceaccount:default:worker-[ab]", true},
+		{"*:*:*-[ab]", "system:serviceaccount:default:worker-a", false},
+		{`system:serviceaccount:default:a\*`, `system:serviceaccount:default:a\b`, true},
+		{"a*b*c", "abxbxc", true},
+		{"a*b*c", "abxbx", false},
+		{"**", "", true},
+	}
+	for _, tt := range tests {
+		if got := stringLike(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("stringLike(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestIRSALinksFromFixtures(t *testing.T) {
+	ag := fixtureGraph(t)
+	want := map[string]IRSALink{
+		"default:s3-echoer":  {Role: "arn:aws:iam::123456789012:role/s3-echoer", Annotated: true, Trusted: true},
+		"apps:upload-images": {Role: "arn:aws:iam::123456789012:role/s3-uploader", Annotated: true, Trusted: true},
+		"default:batch":      {Role: "arn:aws:iam::123456789012:role/batch-jobs", Annotated: true, Trusted: true, TrustsAll: true},
+	}
+	for sakey, w := range want {
+		w.ServiceAccount = sakey
+		links := ag.irsaLinksOf(sakey)
+		if len(links) != 1 || links[0] != w {
+			t.Errorf("got IRSA links %+v of %v, want %+v", links, sakey, w)
+			continue
+		}
+		if links[0].mismatch() {
+			t.Errorf("got a mismatch for %v", sakey)
+		}
+	}
+	if links := ag.irsaLinksOf("arn:aws:iam::123456789012:role/batch-jobs"); len(links) != 1 {
+		t.Errorf("got IRSA links %+v of batch-jobs, want only the annotated service account", links)
+	}
+	if links := ag.irsaLinksOf("default:default"); len(links) != 0 {
+		t.Errorf("got IRSA links %+v of default:default, want none", links)
+	}
+}
+
+func TestIRSAMismatch(t *testing.T) {
+	ag := fixtureGraph(t)
+	sa := ag.ServiceAccounts["default:default"]
+	sa.Annotations = map[string]string{irsaAnnotation: "arn:aws:iam::123456789012:role/s3-uploader"}
+	ag.ServiceAccounts["default:default"] = sa
+	links := ag.irsaLinksOf("default:default")
+	if len(links) != 1 || !links[0].mismatch() {
+		t.Errorf("got IRSA links %+v of default:default, want a mismatch", links)
+	}
+}
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"strings"
-
-	"github.com/mhausenblas/kubecuddler"
 )
 
 // namespaceit joins Kubernetes namespace and name.
@@ -13,45 +10,99 @@ func namespaceit(ns, name string) string {
 	return fmt.Sprintf("%v:%v", ns, name)
 }
 
-// kubeIdentity queries the local Kube config to retrieve the configuration.
-func (ag *AccessGraph) kubeIdentity() error {
-	res, err := kubecuddler.Kubectl(false, false, "", "config", "view", "--minify", "--output", "json")
-	if err != nil {
-		return err
+// kubekey builds the key of a Kubernetes object in the access graph from
+// its cluster, namespace and name: NAMESPACE:NAME for namespaced objects
+// and NAME for cluster-wide ones, prefixed with CLUSTER/ if the access
+// graph spans several clusters.
+func kubekey(cluster, ns, name string) string {
+	key := name
+	if ns != "" {
+		key = namespaceit(ns, name)
 	}
-	sr := strings.NewReader(res)
-	decoder := json.NewDecoder(sr)
-	kconf := &Config{}
-	err = decoder.Decode(kconf)
+	if cluster != "" {
+		key = cluster + "/" + key
+	}
+	return key
+}
+
+// kubeIdentity retrieves the Kubernetes client configuration. With several
+// clusters, the contexts, clusters and users are merged into one config.
+func (ag *AccessGraph) kubeIdentity(src KubeSource) error {
+	kconf, err := src.Config()
 	if err != nil {
 		return err
 	}
-	ag.KubeConfig = kconf
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.KubeConfig == nil {
+		ag.KubeConfig = kconf
+		return nil
+	}
+	for _, c := range kconf.Clusters {
+		if !hasNamedCluster(ag.KubeConfig.Clusters, c.Name) {
+			ag.KubeConfig.Clusters = append(ag.KubeConfig.Clusters, c)
+		}
+	}
+	for _, ai := range kconf.AuthInfos {
+		if !hasNamedAuthInfo(ag.KubeConfig.AuthInfos, ai.Name) {
+			ag.KubeConfig.AuthInfos = append(ag.KubeConfig.AuthInfos, ai)
+		}
+	}
+	ag.KubeConfig.Contexts = append(ag.KubeConfig.Contexts, kconf.Contexts...)
 	return nil
 }
 
+// hasNamedCluster checks if a cluster with the given name is in clusters.
+func hasNamedCluster(clusters []NamedCluster, name string) bool {
+	for _, c := range clusters {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNamedAuthInfo checks if a user with the given name is in authinfos.
+func hasNamedAuthInfo(authinfos []NamedAuthInfo, name string) bool {
+	for _, ai := range authinfos {
+		if ai.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNamedContext checks if a context with the given name is in contexts.
+func hasNamedContext(contexts []NamedContext, name string) bool {
+	for _, kctx := range contexts {
+		if kctx.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // kubeServiceAccounts retrieves the service accounts in the cluster.
-func (ag *AccessGraph) kubeServiceAccounts() error {
-	res, err := kubecuddler.Kubectl(false, false, "", "get", "sa", "--all-namespaces", "--output", "json")
+func (ag *AccessGraph) kubeServiceAccounts(cluster string, src KubeSource) error {
+	sal, err := src.ServiceAccounts()
 	if err != nil {
 		return err
 	}
-	sr := strings.NewReader(res)
-	decoder := json.NewDecoder(sr)
-	sal := ServiceAccountList{}
-	err = decoder.Decode(&sal)
-	if err != nil {
-		return err
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.ServiceAccounts == nil {
+		ag.ServiceAccounts = make(map[string]ServiceAccount)
 	}
-	ag.ServiceAccounts = make(map[string]ServiceAccount)
-	for _, sa := range sal.Items {
-		ag.ServiceAccounts[namespaceit(sa.Namespace, sa.Name)] = sa
+	for _, sa := range sal {
+		sa.ClusterName = cluster
+		ag.ServiceAccounts[kubekey(cluster, sa.Namespace, sa.Name)] = sa
 	}
 	return nil
 }
 
-// formatSA provides a textual rendering of the service account.
-func formatSA(sa *ServiceAccount) string {
+// formatSA provides a textual rendering of the service account, including
+// the IAM roles it is linked to via IRSA and its effective permissions.
+func formatSA(ag *AccessGraph, sa *ServiceAccount) string {
 	var secrets strings.Builder
 	for _, sec := range sa.Secrets {
 		secrets.WriteString(sec.Name + " ")
@@ -59,49 +110,42 @@ func formatSA(sa *ServiceAccount) string {
 	return fmt.Sprintf(
 		"     Namespace: %v\n"+
 			"     Name: %v\n"+
-			"     Secrets: %v\n",
+			"     Secrets: %v\n"+
+			"     IAM roles (IRSA): %v\n"+
+			"     Effective permissions:\n%v",
 		sa.Namespace,
 		sa.Name,
 		secrets.String(),
+		formatIRSALinks(ag.irsaLinksOf(kubekey(sa.ClusterName, sa.Namespace, sa.Name)), true),
+		formatPermissions(ag.saPermissions(sa.ClusterName, sa.Namespace, sa.Name)),
 	)
 }
 
 // kubeSecrets retrieves the secrets in the cluster.
-func (ag *AccessGraph) kubeSecrets() error {
-	res, err := kubecuddler.Kubectl(false, false, "", "get", "secrets", "--all-namespaces", "--output", "json")
+func (ag *AccessGraph) kubeSecrets(cluster string, src KubeSource) error {
+	secl, err := src.Secrets()
 	if err != nil {
 		return err
 	}
-	sr := strings.NewReader(res)
-	decoder := json.NewDecoder(sr)
-	secl := SecretList{}
-	err = decoder.Decode(&secl)
-	if err != nil {
-		return err
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.Secrets == nil {
+		ag.Secrets = make(map[string]Secret)
 	}
-	ag.Secrets = make(map[string]Secret)
-	for _, secret := range secl.Items {
-		ag.Secrets[namespaceit(secret.Namespace, secret.Name)] = secret
+	for _, secret := range secl {
+		secret.ClusterName = cluster
+		ag.Secrets[kubekey(cluster, secret.Namespace, secret.Name)] = secret
 	}
 	return nil
 }
 
-// formatSecret provides a textual rendering of the secret.
+// formatSecret provides a textual rendering of the secret, with its values
+// redacted.
 func formatSecret(secret *Secret) string {
-	strdatamap := ""
-	// case of string data present:
-	if len(secret.StringData) != 0 {
-		for k, v := range secret.StringData {
-			strdatamap += fmt.Sprintf("%v: %v ", k, v)
-		}
-	}
-	datamap := ""
-	// case of data present:
-	if len(secret.Data) != 0 {
-		for k, v := range secret.Data {
-			datamap += fmt.Sprintf("\n      %v: %v ", k, string(v))
-		}
-	}
+	// never show the values, only their size and fingerprint, see also revealSecret():
+	sv := redactedSecret(*secret)
+	strdatamap := formatRedactedValues(sv.StringData, sv.Redacted)
+	datamap := formatRedactedValues(sv.Data, sv.Redacted)
 	return fmt.Sprintf(
 		"     Namespace: %v\n"+
 			"     Name: %v\n"+
@@ -117,27 +161,30 @@ func formatSecret(secret *Secret) string {
 }
 
 // kubePods retrieves the pods in the cluster.
-func (ag *AccessGraph) kubePods() error {
-	res, err := kubecuddler.Kubectl(false, false, "", "get", "pods", "--all-namespaces", "--output", "json")
+func (ag *AccessGraph) kubePods(cluster string, src KubeSource) error {
+	podl, err := src.Pods()
 	if err != nil {
 		return err
 	}
-	sr := strings.NewReader(res)
-	decoder := json.NewDecoder(sr)
-	podl := PodList{}
-	err = decoder.Decode(&podl)
-	if err != nil {
-		return err
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.Pods == nil {
+		ag.Pods = make(map[string]Pod)
 	}
-	ag.Pods = make(map[string]Pod)
-	for _, pod := range podl.Items {
-		ag.Pods[namespaceit(pod.Namespace, pod.Name)] = pod
+	for _, pod := range podl {
+		pod.ClusterName = cluster
+		ag.Pods[kubekey(cluster, pod.Namespace, pod.Name)] = pod
 	}
 	return nil
 }
 
-// formatPod provides a textual rendering of the pod.
-func formatPod(pod *Pod) string {
+// formatPod provides a textual rendering of the pod, including the IAM
+// role that effectively serves as its AWS identity.
+func formatPod(ag *AccessGraph, pod *Pod) string {
+	identity := "n/a"
+	if rolearn, via := ag.podRole(pod); rolearn != "" {
+		identity = fmt.Sprintf("%v (via %v)", rolearn, via)
+	}
 	strcontainers := ""
 	for _, container := range pod.Spec.Containers {
 		strcontainers += fmt.Sprintf(
@@ -164,7 +211,8 @@ func formatPod(pod *Pod) string {
 			"     Containers:\n %v\n"+
 			"     Host IP: %v\n"+
 			"     Pod IP: %v\n"+
-			"     Phase: %v\n",
+			"     Phase: %v\n"+
+			"     AWS identity: %v\n",
 		pod.Namespace,
 		pod.Name,
 		pod.Spec.ServiceAccountName,
@@ -174,5 +222,175 @@ func formatPod(pod *Pod) string {
 		pod.Status.HostIP,
 		pod.Status.PodIP,
 		pod.Status.Phase,
+		identity,
+	)
+}
+
+// kubeRoles retrieves the roles in the cluster.
+func (ag *AccessGraph) kubeRoles(cluster string, src KubeSource) error {
+	rl, err := src.Roles()
+	if err != nil {
+		return err
+	}
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.KubeRoles == nil {
+		ag.KubeRoles = make(map[string]Role)
+	}
+	for _, role := range rl {
+		role.ClusterName = cluster
+		ag.KubeRoles[kubekey(cluster, role.Namespace, role.Name)] = role
+	}
+	return nil
+}
+
+// kubeClusterRoles retrieves the cluster roles in the cluster.
+func (ag *AccessGraph) kubeClusterRoles(cluster string, src KubeSource) error {
+	crl, err := src.ClusterRoles()
+	if err != nil {
+		return err
+	}
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.KubeClusterRoles == nil {
+		ag.KubeClusterRoles = make(map[string]ClusterRole)
+	}
+	for _, crole := range crl {
+		crole.ClusterName = cluster
+		ag.KubeClusterRoles[kubekey(cluster, crole.Namespace, crole.Name)] = crole
+	}
+	return nil
+}
+
+// kubeRoleBindings retrieves the role bindings in the cluster.
+func (ag *AccessGraph) kubeRoleBindings(cluster string, src KubeSource) error {
+	rbl, err := src.RoleBindings()
+	if err != nil {
+		return err
+	}
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.KubeRoleBindings == nil {
+		ag.KubeRoleBindings = make(map[string]RoleBinding)
+	}
+	for _, rb := range rbl {
+		rb.ClusterName = cluster
+		ag.KubeRoleBindings[kubekey(cluster, rb.Namespace, rb.Name)] = rb
+	}
+	return nil
+}
+
+// kubeClusterRoleBindings retrieves the cluster role bindings in the cluster.
+func (ag *AccessGraph) kubeClusterRoleBindings(cluster string, src KubeSource) error {
+	crbl, err := src.ClusterRoleBindings()
+	if err != nil {
+		return err
+	}
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	if ag.KubeClusterRoleBindings == nil {
+		ag.KubeClusterRoleBindings = make(map[string]ClusterRoleBinding)
+	}
+	for _, crb := range crbl {
+		crb.ClusterName = cluster
+		ag.KubeClusterRoleBindings[kubekey(cluster, crb.Namespace, crb.Name)] = crb
+	}
+	return nil
+}
+
+// formatRules provides a textual rendering of RBAC policy rules.
+func formatRules(rules []PolicyRule) string {
+	if len(rules) == 0 {
+		return "\n      n/a"
+	}
+	var b strings.Builder
+	for _, rule := range rules {
+		switch {
+		case len(rule.NonResourceURLs) > 0:
+			b.WriteString(fmt.Sprintf("\n      %v on non-resource URLs %v",
+				strings.Join(rule.Verbs, ","),
+				strings.Join(rule.NonResourceURLs, ","),
+			))
+		default:
+			b.WriteString(fmt.Sprintf("\n      %v on %v in API groups %q",
+				strings.Join(rule.Verbs, ","),
+				strings.Join(rule.Resources, ","),
+				rule.APIGroups,
+			))
+			if len(rule.ResourceNames) > 0 {
+				b.WriteString(fmt.Sprintf(" limited to %v", strings.Join(rule.ResourceNames, ",")))
+			}
+		}
+	}
+	return b.String()
+}
+
+// formatSubjects provides a textual rendering of RBAC subjects.
+func formatSubjects(subjects []Subject) string {
+	if len(subjects) == 0 {
+		return "\n      n/a"
+	}
+	var b strings.Builder
+	for _, subject := range subjects {
+		name := subject.Name
+		if subject.Namespace != "" {
+			name = namespaceit(subject.Namespace, subject.Name)
+		}
+		b.WriteString(fmt.Sprintf("\n      %v %v", subject.Kind, name))
+	}
+	return b.String()
+}
+
+// formatKubeRole provides a textual rendering of the role.
+func formatKubeRole(role *Role) string {
+	return fmt.Sprintf(
+		"     Namespace: %v\n"+
+			"     Name: %v\n"+
+			"     Kind: Role\n"+
+			"     Rules: %v\n",
+		role.Namespace,
+		role.Name,
+		formatRules(role.Rules),
+	)
+}
+
+// formatClusterRole provides a textual rendering of the cluster role.
+func formatClusterRole(crole *ClusterRole) string {
+	return fmt.Sprintf(
+		"     Name: %v\n"+
+			"     Kind: ClusterRole\n"+
+			"     Rules: %v\n",
+		crole.Name,
+		formatRules(crole.Rules),
+	)
+}
+
+// formatRoleBinding provides a textual rendering of the role binding.
+func formatRoleBinding(rb *RoleBinding) string {
+	return fmt.Sprintf(
+		"     Namespace: %v\n"+
+			"     Name: %v\n"+
+			"     Kind: RoleBinding\n"+
+			"     Role: %v %v\n"+
+			"     Subjects: %v\n",
+		rb.Namespace,
+		rb.Name,
+		rb.RoleRef.Kind,
+		rb.RoleRef.Name,
+		formatSubjects(rb.Subjects),
+	)
+}
+
+// formatClusterRoleBinding provides a textual rendering of the cluster role binding.
+func formatClusterRoleBinding(crb *ClusterRoleBinding) string {
+	return fmt.Sprintf(
+		"     Name: %v\n"+
+			"     Kind: ClusterRoleBinding\n"+
+			"     Role: %v %v\n"+
+			"     Subjects: %v\n",
+		crb.Name,
+		crb.RoleRef.Kind,
+		crb.RoleRef.Name,
+		formatSubjects(crb.Subjects),
 	)
 }
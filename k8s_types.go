@@ -5,11 +5,13 @@ package main
 
 // ObjectMeta is metadata that all persisted resources must have.
 type ObjectMeta struct {
-	Name        string            `json:"name,omitempty"`
-	Namespace   string            `json:"namespace,omitempty"`
-	Labels      map[string]string `json:"labels,omitempty"`
-	Annotations map[string]string `json:"annotations,omitempty"`
-	ClusterName string            `json:"clusterName,omitempty"`
+	Name            string            `json:"name,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	ClusterName     string            `json:"clusterName,omitempty"`
 }
 
 // ServiceAccountList is a list of service accounts.
@@ -27,6 +29,26 @@ type PodList struct {
 	Items []Pod `json:"items"`
 }
 
+// RoleList is a list of roles.
+type RoleList struct {
+	Items []Role `json:"items"`
+}
+
+// ClusterRoleList is a list of cluster roles.
+type ClusterRoleList struct {
+	Items []ClusterRole `json:"items"`
+}
+
+// RoleBindingList is a list of role bindings.
+type RoleBindingList struct {
+	Items []RoleBinding `json:"items"`
+}
+
+// ClusterRoleBindingList is a list of cluster role bindings.
+type ClusterRoleBindingList struct {
+	Items []ClusterRoleBinding `json:"items"`
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // https://github.com/kubernetes/kubernetes/blob/master/staging/src/k8s.io/api/core/v1/types.go
 
@@ -59,6 +81,12 @@ type Secret struct {
 	Type       SecretType        `json:"type,omitempty"`
 }
 
+// ConfigMap holds configuration data for pods to consume.
+type ConfigMap struct {
+	ObjectMeta `json:"metadata,omitempty"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
 // SecretType is a custom data type facilitating programmatic handling of
 // secret data.
 type SecretType string
@@ -129,6 +157,63 @@ type PodConditionType string
 // ConditionStatus provides the status.
 type ConditionStatus string
 
+////////////////////////////////////////////////////////////////////////////////
+// https://github.com/kubernetes/kubernetes/blob/master/staging/src/k8s.io/api/rbac/v1/types.go
+
+// PolicyRule holds information that describes a policy rule, but does not
+// contain information about who the rule applies to.
+type PolicyRule struct {
+	Verbs           []string `json:"verbs"`
+	APIGroups       []string `json:"apiGroups,omitempty"`
+	Resources       []string `json:"resources,omitempty"`
+	ResourceNames   []string `json:"resourceNames,omitempty"`
+	NonResourceURLs []string `json:"nonResourceURLs,omitempty"`
+}
+
+// Subject holds a reference to the object or user identity a role binding
+// applies to: a service account, a user or a group.
+type Subject struct {
+	Kind      string `json:"kind"`
+	APIGroup  string `json:"apiGroup,omitempty"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// RoleRef contains information that points to the role being used.
+type RoleRef struct {
+	APIGroup string `json:"apiGroup"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+}
+
+// Role is a namespaced, logical grouping of policy rules.
+type Role struct {
+	ObjectMeta `json:"metadata,omitempty"`
+	Rules      []PolicyRule `json:"rules"`
+}
+
+// ClusterRole is a cluster-level, logical grouping of policy rules.
+type ClusterRole struct {
+	ObjectMeta `json:"metadata,omitempty"`
+	Rules      []PolicyRule `json:"rules"`
+}
+
+// RoleBinding references a role, but does not contain it, and grants the
+// permissions defined in it to the subjects within a namespace.
+type RoleBinding struct {
+	ObjectMeta `json:"metadata,omitempty"`
+	Subjects   []Subject `json:"subjects,omitempty"`
+	RoleRef    RoleRef   `json:"roleRef"`
+}
+
+// ClusterRoleBinding references a cluster role, but does not contain it,
+// and grants the permissions defined in it to the subjects cluster-wide.
+type ClusterRoleBinding struct {
+	ObjectMeta `json:"metadata,omitempty"`
+	Subjects   []Subject `json:"subjects,omitempty"`
+	RoleRef    RoleRef   `json:"roleRef"`
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // https://github.com/kubernetes/client-go/blob/master/tools/clientcmd/api/v1/types.go
 
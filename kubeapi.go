@@ -0,0 +1,622 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// defaultKubeTimeout is the timeout for requests against the Kubernetes API
+// server, unless overwritten by the RBIAM_KUBE_TIMEOUT environment variable.
+const defaultKubeTimeout = 30 * time.Second
+
+// inClusterDir is where Kubernetes mounts the service account token and
+// CA certificate into pods.
+const inClusterDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeMaxRetries is how often requests the API server throttles are retried,
+// with kubeBackoff being the delay before the first retry, doubling with
+// each attempt, unless the API server tells us how long to wait.
+const (
+	kubeMaxRetries = 5
+	kubeBackoff    = 500 * time.Millisecond
+)
+
+// KubeAPIError is a structured error for failed requests against the
+// Kubernetes API server, carrying the context and the status returned.
+type KubeAPIError struct {
+	// Context is the name of the kube context used.
+	Context string
+	// Server is the address of the API server.
+	Server string
+	// Path is the API path requested, for example /api/v1/pods.
+	Path string
+	// StatusCode is the HTTP status code, zero if the request didn't
+	// get a response, for example due to a timeout.
+	StatusCode int
+	// Reason is the machine-readable reason, for example Forbidden.
+	Reason string
+	// Message is the human-readable description of the error.
+	Message string
+	// retryAfter is how long the API server asks us to wait before
+	// retrying, as per the Retry-After header, if any.
+	retryAfter time.Duration
+}
+
+// Error provides a textual rendering of the error.
+func (e *KubeAPIError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("context %v: request to %v%v failed: %v", e.Context, e.Server, e.Path, e.Message)
+	}
+	return fmt.Sprintf("context %v: request to %v%v failed with %v %v: %v", e.Context, e.Server, e.Path, e.StatusCode, e.Reason, e.Message)
+}
+
+// kubeAPISource is the live Kubernetes source, talking directly to the API
+// server as configured in the kubeconfig, so no kubectl binary is needed.
+type kubeAPISource struct {
+	// err is set if the source couldn't be set up, and then returned by
+	// all methods.
+	err error
+	// context is the name of the selected kube context.
+	context string
+	// config is the minified client configuration for the selected context.
+	config *Config
+	// server is the address of the API server.
+	server string
+	// client is the HTTP client, set up with TLS config and timeout.
+	client *http.Client
+	// token is the bearer token, if any.
+	token string
+	// username and password are used for basic authentication, if set.
+	username string
+	password string
+	// impersonate and impersonategroups are the user and groups to act as.
+	impersonate       string
+	impersonategroups []string
+}
+
+// newKubeAPISource sets up a Kubernetes source for the kube context
+// kubecontext, with an empty kubecontext meaning the current context of the
+// kubeconfig. The kubeconfig is taken from the KUBECONFIG environment
+// variable or ~/.kube/config, and if there is none but we're running in a
+// pod, the in-cluster configuration is used. Any error is deferred to the
+// first query, so that the IAM part of the access graph is unaffected.
+func newKubeAPISource(kubecontext string) *kubeAPISource {
+	timeout, err := kubeTimeout()
+	if err != nil {
+		return &kubeAPISource{err: err}
+	}
+	kubeconfig, err := loadKubeconfig()
+	if err != nil {
+		return &kubeAPISource{err: err}
+	}
+	if kubeconfig == nil {
+		return newInClusterSource(timeout)
+	}
+	src, err := kubeconfigSource(kubeconfig, kubecontext, timeout)
+	if err != nil {
+		return &kubeAPISource{err: err}
+	}
+	return src
+}
+
+// kubeTimeout returns the timeout for requests against the API server,
+// as set via the RBIAM_KUBE_TIMEOUT environment variable, for example 2m.
+func kubeTimeout() (time.Duration, error) {
+	t := os.Getenv("RBIAM_KUBE_TIMEOUT")
+	if t == "" {
+		return defaultKubeTimeout, nil
+	}
+	d, err := time.ParseDuration(t)
+	if err != nil {
+		return 0, fmt.Errorf("invalid RBIAM_KUBE_TIMEOUT %q: %v", t, err)
+	}
+	return d, nil
+}
+
+// loadKubeconfig reads and parses the kubeconfig from the paths in the
+// KUBECONFIG environment variable or otherwise ~/.kube/config, returning nil
+// if there is no kubeconfig at all. Like kubectl, we merge several files,
+// with the first file to define a cluster, user or context, or the current
+// context, winning, and skip files that don't exist.
+func loadKubeconfig() (*Config, error) {
+	paths := []string{}
+	if kc := os.Getenv("KUBECONFIG"); kc != "" {
+		for _, path := range filepath.SplitList(kc) {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+	} else {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		paths = append(paths, filepath.Join(home, ".kube", "config"))
+	}
+	var merged *Config
+	for _, path := range paths {
+		kubeconfig, err := readKubeconfig(path)
+		if err != nil {
+			return nil, err
+		}
+		if kubeconfig == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &Config{}
+		}
+		mergeKubeconfig(merged, kubeconfig)
+	}
+	return merged, nil
+}
+
+// readKubeconfig reads and parses the kubeconfig file at path, returning nil
+// if it doesn't exist. Relative paths of files the kubeconfig refers to,
+// such as certificates, are resolved against the directory of the
+// kubeconfig, as kubectl does.
+func readKubeconfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("can't read kubeconfig %v: %v", path, err)
+	}
+	kubeconfig := &Config{}
+	err = yaml.Unmarshal(b, kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse kubeconfig %v: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	resolve := func(file *string) {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(dir, *file)
+		}
+	}
+	for i := range kubeconfig.Clusters {
+		resolve(&kubeconfig.Clusters[i].Cluster.CertificateAuthority)
+	}
+	for i := range kubeconfig.AuthInfos {
+		ai := &kubeconfig.AuthInfos[i].AuthInfo
+		resolve(&ai.ClientCertificate)
+		resolve(&ai.ClientKey)
+		resolve(&ai.TokenFile)
+	}
+	return kubeconfig, nil
+}
+
+// mergeKubeconfig adds the clusters, users and contexts of kubeconfig to
+// merged, unless merged already has one with the same name, and takes the
+// current context of kubeconfig, unless merged already has one.
+func mergeKubeconfig(merged, kubeconfig *Config) {
+	for _, c := range kubeconfig.Clusters {
+		if !hasNamedCluster(merged.Clusters, c.Name) {
+			merged.Clusters = append(merged.Clusters, c)
+		}
+	}
+	for _, ai := range kubeconfig.AuthInfos {
+		if !hasNamedAuthInfo(merged.AuthInfos, ai.Name) {
+			merged.AuthInfos = append(merged.AuthInfos, ai)
+		}
+	}
+	for _, kctx := range kubeconfig.Contexts {
+		if !hasNamedContext(merged.Contexts, kctx.Name) {
+			merged.Contexts = append(merged.Contexts, kctx)
+		}
+	}
+	if merged.CurrentContext == "" {
+		merged.CurrentContext = kubeconfig.CurrentContext
+	}
+}
+
+// kubeconfigSource sets up a Kubernetes source from the kube context
+// kubecontext of kubeconfig, defaulting to the current context.
+func kubeconfigSource(kubeconfig *Config, kubecontext string, timeout time.Duration) (*kubeAPISource, error) {
+	if kubecontext == "" {
+		kubecontext = kubeconfig.CurrentContext
+	}
+	var kctx *NamedContext
+	for i := range kubeconfig.Contexts {
+		if kubeconfig.Contexts[i].Name == kubecontext {
+			kctx = &kubeconfig.Contexts[i]
+		}
+	}
+	if kctx == nil {
+		return nil, fmt.Errorf("no context %q in kubeconfig", kubecontext)
+	}
+	var cluster *NamedCluster
+	for i := range kubeconfig.Clusters {
+		if kubeconfig.Clusters[i].Name == kctx.Context.Cluster {
+			cluster = &kubeconfig.Clusters[i]
+		}
+	}
+	if cluster == nil {
+		return nil, fmt.Errorf("no cluster %q for context %q in kubeconfig", kctx.Context.Cluster, kubecontext)
+	}
+	authinfo := &NamedAuthInfo{Name: kctx.Context.AuthInfo}
+	for i := range kubeconfig.AuthInfos {
+		if kubeconfig.AuthInfos[i].Name == kctx.Context.AuthInfo {
+			authinfo = &kubeconfig.AuthInfos[i]
+		}
+	}
+	src := &kubeAPISource{
+		context: kubecontext,
+		server:  strings.TrimSuffix(cluster.Cluster.Server, "/"),
+		config:  minify(kctx, cluster, authinfo),
+	}
+	tlsconf := &tls.Config{InsecureSkipVerify: cluster.Cluster.InsecureSkipTLSVerify}
+	cadata := cluster.Cluster.CertificateAuthorityData
+	if len(cadata) == 0 && cluster.Cluster.CertificateAuthority != "" {
+		b, err := ioutil.ReadFile(cluster.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("can't read certificate authority of cluster %q: %v", cluster.Name, err)
+		}
+		cadata = b
+	}
+	if len(cadata) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cadata) {
+			return nil, fmt.Errorf("invalid certificate authority data for cluster %q", cluster.Name)
+		}
+		tlsconf.RootCAs = pool
+	}
+	ai := authinfo.AuthInfo
+	certdata, keydata := ai.ClientCertificateData, ai.ClientKeyData
+	if len(certdata) == 0 && ai.ClientCertificate != "" {
+		b, err := ioutil.ReadFile(ai.ClientCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("can't read client certificate of user %q: %v", authinfo.Name, err)
+		}
+		certdata = b
+	}
+	if len(keydata) == 0 && ai.ClientKey != "" {
+		b, err := ioutil.ReadFile(ai.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't read client key of user %q: %v", authinfo.Name, err)
+		}
+		keydata = b
+	}
+	src.token = ai.Token
+	if src.token == "" && ai.TokenFile != "" {
+		b, err := ioutil.ReadFile(ai.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read token file of user %q: %v", authinfo.Name, err)
+		}
+		src.token = strings.TrimSpace(string(b))
+	}
+	src.username, src.password = ai.Username, ai.Password
+	src.impersonate, src.impersonategroups = ai.Impersonate, ai.ImpersonateGroups
+	switch {
+	case ai.Exec != nil:
+		cred, err := execCredential(ai.Exec)
+		if err != nil {
+			return nil, fmt.Errorf("can't get credentials for user %q: %v", authinfo.Name, err)
+		}
+		if cred.Token != "" {
+			src.token = cred.Token
+		}
+		if cred.ClientCertificateData != "" {
+			certdata, keydata = []byte(cred.ClientCertificateData), []byte(cred.ClientKeyData)
+		}
+	case ai.AuthProvider != nil:
+		return nil, fmt.Errorf("auth provider %q of user %q is not supported, consider using an exec plugin", ai.AuthProvider.Name, authinfo.Name)
+	}
+	if len(certdata) > 0 {
+		cert, err := tls.X509KeyPair(certdata, keydata)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate of user %q: %v", authinfo.Name, err)
+		}
+		tlsconf.Certificates = []tls.Certificate{cert}
+	}
+	src.client = &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsconf, Proxy: http.ProxyFromEnvironment},
+	}
+	return src, nil
+}
+
+// newInClusterSource sets up a Kubernetes source using the service account
+// token and CA certificate Kubernetes mounts into pods.
+func newInClusterSource(timeout time.Duration) *kubeAPISource {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return &kubeAPISource{err: fmt.Errorf("no kubeconfig found and not running in a Kubernetes cluster")}
+	}
+	token, err := ioutil.ReadFile(filepath.Join(inClusterDir, "token"))
+	if err != nil {
+		return &kubeAPISource{err: fmt.Errorf("can't read in-cluster service account token: %v", err)}
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(inClusterDir, "ca.crt"))
+	if err != nil {
+		return &kubeAPISource{err: fmt.Errorf("can't read in-cluster CA certificate: %v", err)}
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	server := "https://" + host + ":" + port
+	return &kubeAPISource{
+		context: "in-cluster",
+		server:  server,
+		config: &Config{
+			Clusters:       []NamedCluster{{Name: "in-cluster", Cluster: Cluster{Server: server}}},
+			Contexts:       []NamedContext{{Name: "in-cluster", Context: Context{Cluster: "in-cluster"}}},
+			CurrentContext: "in-cluster",
+		},
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		token: strings.TrimSpace(string(token)),
+	}
+}
+
+// minify creates a client configuration with only the given context, cluster
+// and user, like 'kubectl config view --minify' does. Since the configuration
+// ends up in dumps we omit credentials, certificate data and the environment
+// of exec plugins.
+func minify(kctx *NamedContext, cluster *NamedCluster, authinfo *NamedAuthInfo) *Config {
+	c := *cluster
+	c.Cluster.CertificateAuthorityData = nil
+	ai := NamedAuthInfo{Name: authinfo.Name}
+	if authinfo.AuthInfo.Exec != nil {
+		// the environment of exec plugins may hold credentials, too:
+		ec := *authinfo.AuthInfo.Exec
+		ec.Env = nil
+		ai.AuthInfo.Exec = &ec
+	}
+	ai.AuthInfo.Username = authinfo.AuthInfo.Username
+	return &Config{
+		Clusters:       []NamedCluster{c},
+		AuthInfos:      []NamedAuthInfo{ai},
+		Contexts:       []NamedContext{*kctx},
+		CurrentContext: kctx.Name,
+	}
+}
+
+// ExecCredentialStatus holds the credentials returned by an exec-based
+// credential plugin such as 'aws eks get-token'.
+type ExecCredentialStatus struct {
+	Token                 string `json:"token,omitempty"`
+	ClientCertificateData string `json:"clientCertificateData,omitempty"`
+	ClientKeyData         string `json:"clientKeyData,omitempty"`
+}
+
+// defaultExecAPIVersion is the version of the ExecCredential API we pass to
+// exec plugins that don't ask for a specific one.
+const defaultExecAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+// execCredential runs the exec-based credential plugin as configured in
+// ec and returns the credentials it provides. Like kubectl, we describe the
+// request in the KUBERNETES_EXEC_INFO environment variable, which some
+// plugins require, and since we don't pass on stdin, it's non-interactive.
+func execCredential(ec *ExecConfig) (*ExecCredentialStatus, error) {
+	apiversion := ec.APIVersion
+	if apiversion == "" {
+		apiversion = defaultExecAPIVersion
+	}
+	info, err := json.Marshal(map[string]interface{}{
+		"apiVersion": apiversion,
+		"kind":       "ExecCredential",
+		"spec":       map[string]interface{}{"interactive": false},
+	})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(ec.Command, ec.Args...)
+	cmd.Env = os.Environ()
+	for _, envar := range ec.Env {
+		cmd.Env = append(cmd.Env, envar.Name+"="+envar.Value)
+	}
+	cmd.Env = append(cmd.Env, "KUBERNETES_EXEC_INFO="+string(info))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v failed: %v %v", ec.Command, err, strings.TrimSpace(stderr.String()))
+	}
+	cred := struct {
+		Status *ExecCredentialStatus `json:"status"`
+	}{}
+	err = json.Unmarshal(out, &cred)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode output of %v: %v", ec.Command, err)
+	}
+	if cred.Status == nil {
+		return nil, fmt.Errorf("%v returned no credentials", ec.Command)
+	}
+	return cred.Status, nil
+}
+
+// get queries the API server for path and decodes the JSON response into v.
+// Errors are reported as KubeAPIError. If the API server throttles us, with
+// a 429 Too Many Requests status, we back off and retry.
+func (src *kubeAPISource) get(path string, v interface{}) error {
+	backoff := kubeBackoff
+	for retries := 0; ; retries++ {
+		err := src.attempt(path, v)
+		apierr, ok := err.(*KubeAPIError)
+		if !ok || apierr.StatusCode != http.StatusTooManyRequests || retries == kubeMaxRetries {
+			return err
+		}
+		delay := backoff
+		if apierr.retryAfter > 0 {
+			delay = apierr.retryAfter
+		}
+		time.Sleep(delay)
+		backoff *= 2
+	}
+}
+
+// attempt queries the API server for path once, see also get().
+func (src *kubeAPISource) attempt(path string, v interface{}) error {
+	apierr := &KubeAPIError{Context: src.context, Server: src.server, Path: path}
+	req, err := http.NewRequest("GET", src.server+path, nil)
+	if err != nil {
+		apierr.Message = err.Error()
+		return apierr
+	}
+	req.Header.Set("Accept", "application/json")
+	switch {
+	case src.token != "":
+		req.Header.Set("Authorization", "Bearer "+src.token)
+	case src.username != "":
+		req.SetBasicAuth(src.username, src.password)
+	}
+	if src.impersonate != "" {
+		req.Header.Set("Impersonate-User", src.impersonate)
+		for _, group := range src.impersonategroups {
+			req.Header.Add("Impersonate-Group", group)
+		}
+	}
+	res, err := src.client.Do(req)
+	if err != nil {
+		apierr.Message = err.Error()
+		return apierr
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		apierr.Message = err.Error()
+		return apierr
+	}
+	if res.StatusCode != http.StatusOK {
+		apierr.StatusCode = res.StatusCode
+		apierr.Reason = http.StatusText(res.StatusCode)
+		apierr.Message = strings.TrimSpace(string(b))
+		if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && secs > 0 {
+			apierr.retryAfter = time.Duration(secs) * time.Second
+		}
+		// the API server usually returns a Status object with details:
+		status := struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(b, &status) == nil && status.Message != "" {
+			apierr.Reason = status.Reason
+			apierr.Message = status.Message
+		}
+		return apierr
+	}
+	return json.Unmarshal(b, v)
+}
+
+// list queries the API server for all items of the collection at path,
+// following the continue token of paginated responses, and decodes the
+// items into the slice items points to.
+func (src *kubeAPISource) list(path string, items interface{}) error {
+	if src.err != nil {
+		return src.err
+	}
+	all := []json.RawMessage{}
+	cont := ""
+	for {
+		page := struct {
+			Metadata struct {
+				Continue string `json:"continue,omitempty"`
+			} `json:"metadata"`
+			Items []json.RawMessage `json:"items"`
+		}{}
+		q := url.Values{}
+		q.Set("limit", "500")
+		if cont != "" {
+			q.Set("continue", cont)
+		}
+		err := src.get(path+"?"+q.Encode(), &page)
+		if err != nil {
+			return err
+		}
+		all = append(all, page.Items...)
+		cont = page.Metadata.Continue
+		if cont == "" {
+			break
+		}
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, items)
+}
+
+// Config returns the minified client configuration of the selected context.
+func (src *kubeAPISource) Config() (*Config, error) {
+	if src.err != nil {
+		return nil, src.err
+	}
+	return src.config, nil
+}
+
+// ServiceAccounts retrieves the service accounts in the cluster.
+func (src *kubeAPISource) ServiceAccounts() ([]ServiceAccount, error) {
+	sal := []ServiceAccount{}
+	err := src.list("/api/v1/serviceaccounts", &sal)
+	return sal, err
+}
+
+// Secrets retrieves the secrets in the cluster.
+func (src *kubeAPISource) Secrets() ([]Secret, error) {
+	secl := []Secret{}
+	err := src.list("/api/v1/secrets", &secl)
+	return secl, err
+}
+
+// Pods retrieves the pods in the cluster.
+func (src *kubeAPISource) Pods() ([]Pod, error) {
+	podl := []Pod{}
+	err := src.list("/api/v1/pods", &podl)
+	return podl, err
+}
+
+// Roles retrieves the roles in the cluster.
+func (src *kubeAPISource) Roles() ([]Role, error) {
+	rl := []Role{}
+	err := src.list("/apis/rbac.authorization.k8s.io/v1/roles", &rl)
+	return rl, err
+}
+
+// ClusterRoles retrieves the cluster roles in the cluster.
+func (src *kubeAPISource) ClusterRoles() ([]ClusterRole, error) {
+	crl := []ClusterRole{}
+	err := src.list("/apis/rbac.authorization.k8s.io/v1/clusterroles", &crl)
+	return crl, err
+}
+
+// RoleBindings retrieves the role bindings in the cluster.
+func (src *kubeAPISource) RoleBindings() ([]RoleBinding, error) {
+	rbl := []RoleBinding{}
+	err := src.list("/apis/rbac.authorization.k8s.io/v1/rolebindings", &rbl)
+	return rbl, err
+}
+
+// ClusterRoleBindings retrieves the cluster role bindings in the cluster.
+func (src *kubeAPISource) ClusterRoleBindings() ([]ClusterRoleBinding, error) {
+	crbl := []ClusterRoleBinding{}
+	err := src.list("/apis/rbac.authorization.k8s.io/v1/clusterrolebindings", &crbl)
+	return crbl, err
+}
+
+// ConfigMap retrieves the config map with the given namespace and name.
+func (src *kubeAPISource) ConfigMap(namespace, name string) (*ConfigMap, error) {
+	if src.err != nil {
+		return nil, src.err
+	}
+	cm := &ConfigMap{}
+	err := src.get(fmt.Sprintf("/api/v1/namespaces/%v/configmaps/%v", namespace, name), cm)
+	if err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLoadKubeconfigMerged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rbiam-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first := filepath.Join(dir, "first")
+	err = ioutil.WriteFile(first, []byte(`
+current-context: dev
+contexts:
+- name: dev
+  context: {cluster: dev, user: alice}
+clusters:
+- name: dev
+  cluster: {server: "https://dev.example.com", certificate-authority: certs/dev-ca.crt}
+users:
+- name: alice
+  user: {client-certificate: /etc/alice.crt, client-key: alice.key}
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := filepath.Join(dir, "more", "second")
+	err = os.MkdirAll(filepath.Dir(second), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(second, []byte(`
+current-context: prod
+contexts:
+- name: prod
+  context: {cluster: prod, user: bob}
+- name: dev
+  context: {cluster: prod, user: bob}
+clusters:
+- name: prod
+  cluster: {server: "https://prod.example.com", certificate-authority: prod-ca.crt}
+users:
+- name: bob
+  user: {tokenFile: bob.token}
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc := filepath.Join(dir, "missing") + string(filepath.ListSeparator) + first + string(filepath.ListSeparator) + second
+	defer os.Setenv("KUBECONFIG", os.Getenv("KUBECONFIG"))
+	os.Setenv("KUBECONFIG", kc)
+	kubeconfig, err := loadKubeconfig()
+	if err != nil {
+		t.Fatalf("can't load kubeconfig: %v", err)
+	}
+	if kubeconfig.CurrentContext != "dev" {
+		t.Errorf("got current context %v, want dev of the first file", kubeconfig.CurrentContext)
+	}
+	if len(kubeconfig.Contexts) != 2 || kubeconfig.Contexts[0].Context.Cluster != "dev" {
+		t.Errorf("got contexts %+v, want dev of the first file and prod", kubeconfig.Contexts)
+	}
+	if len(kubeconfig.Clusters) != 2 || len(kubeconfig.AuthInfos) != 2 {
+		t.Fatalf("got clusters %+v and users %+v, want two each", kubeconfig.Clusters, kubeconfig.AuthInfos)
+	}
+	paths := []struct {
+		name, got, want string
+	}{
+		{"CA of dev", kubeconfig.Clusters[0].Cluster.CertificateAuthority, filepath.Join(dir, "certs", "dev-ca.crt")},
+		{"CA of prod", kubeconfig.Clusters[1].Cluster.CertificateAuthority, filepath.Join(dir, "more", "prod-ca.crt")},
+		{"client certificate of alice", kubeconfig.AuthInfos[0].AuthInfo.ClientCertificate, "/etc/alice.crt"},
+		{"client key of alice", kubeconfig.AuthInfos[0].AuthInfo.ClientKey, filepath.Join(dir, "alice.key")},
+		{"token file of bob", kubeconfig.AuthInfos[1].AuthInfo.TokenFile, filepath.Join(dir, "more", "bob.token")},
+	}
+	for _, p := range paths {
+		if p.got != p.want {
+			t.Errorf("got %v %v, want %v", p.name, p.got, p.want)
+		}
+	}
+}
+
+func TestLoadKubeconfigNone(t *testing.T) {
+	defer os.Setenv("KUBECONFIG", os.Getenv("KUBECONFIG"))
+	os.Setenv("KUBECONFIG", filepath.Join(os.TempDir(), "rbiam-no-such-kubeconfig"))
+	kubeconfig, err := loadKubeconfig()
+	if kubeconfig != nil || err != nil {
+		t.Errorf("got %+v and error %v, want neither", kubeconfig, err)
+	}
+}
+
+func TestMinifyStripsExecEnv(t *testing.T) {
+	exec := &ExecConfig{
+		Command: "aws",
+		Args:    []string{"eks", "get-token"},
+		Env:     []ExecEnvVar{{Name: "AWS_SECRET_ACCESS_KEY", Value: "secret"}},
+	}
+	kctx := &NamedContext{Name: "dev", Context: Context{Cluster: "dev", AuthInfo: "alice"}}
+	cluster := &NamedCluster{Name: "dev", Cluster: Cluster{Server: "https://dev.example.com", CertificateAuthorityData: []byte("ca")}}
+	authinfo := &NamedAuthInfo{Name: "alice", AuthInfo: AuthInfo{Token: "token", Exec: exec}}
+	c := minify(kctx, cluster, authinfo)
+	ai := c.AuthInfos[0].AuthInfo
+	if ai.Token != "" || ai.Exec == nil || ai.Exec.Env != nil || ai.Exec.Command != "aws" {
+		t.Errorf("got user %+v, want the exec plugin without environment and no token", ai)
+	}
+	if len(exec.Env) != 1 {
+		t.Errorf("minify changed the environment of the original exec plugin")
+	}
+	if c.Clusters[0].Cluster.CertificateAuthorityData != nil {
+		t.Errorf("got certificate authority data in minified config")
+	}
+}
+
+func TestExecCredentialInfo(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	// the plugin returns the exec info as token, so we can check it:
+	ec := &ExecConfig{
+		Command:    "sh",
+		Args:       []string{"-c", `printf '{"status":{"token":%s}}' "$(printf '%s' "$KUBERNETES_EXEC_INFO" | sed 's/"/\\"/g; s/^/"/; s/$/"/')"`},
+		APIVersion: "client.authentication.k8s.io/v1",
+	}
+	cred, err := execCredential(ec)
+	if err != nil {
+		t.Fatalf("exec plugin failed: %v", err)
+	}
+	want := `{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","spec":{"interactive":false}}`
+	if cred.Token != want {
+		t.Errorf("got KUBERNETES_EXEC_INFO %v, want %v", cred.Token, want)
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/c-bata/go-prompt"
 )
@@ -19,24 +22,57 @@ var ag *AccessGraph
 // history keeps the selected items such as roles or service accounts around
 var history []string
 
+// outputformat is the global output format, defaulting to text and
+// configurable via the RBIAM_OUTPUT environment variable or the output command
+var outputformat = OutputText
+
+// report is the outcome of the last collection of IAM and Kubernetes info,
+// nil if the access graph has been loaded from a local dump
+var report *CollectionReport
+
+// loadAWSConfig loads the AWS config, see awsConfig() for the memoized one.
+var loadAWSConfig = func() (aws.Config, error) {
+	return external.LoadDefaultAWSConfig()
+}
+
+// awscfg is the AWS config along with the error loading it, loaded on first
+// use only, see awsConfig().
+var awscfg struct {
+	once sync.Once
+	cfg  aws.Config
+	err  error
+}
+
 func main() {
-	cfg, err := external.LoadDefaultAWSConfig()
-	if err != nil {
-		fmt.Printf("Can't load AWS config: %v", err.Error())
-		os.Exit(1)
+	if of := os.Getenv("RBIAM_OUTPUT"); of != "" {
+		f, err := parseOutputFormat(of)
+		if err != nil {
+			fmt.Printf("Can't use output format: %v", err.Error())
+			os.Exit(1)
+		}
+		outputformat = f
 	}
 
-	offline := os.Getenv("RBIAM_OFFLINE")
+	// if there are any arguments we run in non-interactive mode:
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
+	var err error
+	ag, err = initAccessGraph()
 	switch {
-	case offline != "":
-		fmt.Println("Loading IAM and Kubernetes info from local dump.")
-		ag, err = load("rbiam-offline.json")
-		if err != nil {
-			pwarning(fmt.Sprintf("Can't import access graph: %v\n", err))
-		}
+	case err != nil && offlineMode():
+		pwarning(fmt.Sprintf("Can't import access graph: %v\n", err))
+		pwarning("Check RBIAM_OFFLINE, use 'snapshots' to list the available dumps.\n")
+	case err != nil && report == nil:
+		// we couldn't even start collecting, for example without AWS config:
+		fmt.Printf("Can't import access graph: %v", err.Error())
+		os.Exit(1)
+	case err != nil:
+		pwarning(fmt.Sprintf("Can't import access graph: %v\n", err))
+		pwarning("Use 'status' to see which info is missing and 'sync' to try again.\n")
 	default:
-		fmt.Println("Gathering info from IAM and Kubernetes. This may take a bit, please stand by.")
-		ag = NewAccessGraph(cfg)
+		presult(ag.summary())
 	}
 
 	// fmt.Println(ag)
@@ -46,15 +82,44 @@ func main() {
 	cursel := "help" // make sure to first show the help to guide users what to do
 	for {
 		prefix = "? "
+		// commands can override the output format, for example: iam-roles -o json
+		args, of, err := extractOutputFormat(strings.Fields(cursel), outputformat)
+		switch {
+		case err != nil || (len(args) == 0 && strings.TrimSpace(cursel) != ""):
+			// a bad output format, or one on its own, like '-o json', which has
+			// nothing to apply to:
+			if err != nil {
+				pwarning(fmt.Sprintf("%v\n", err))
+			}
+			pwarning(fmt.Sprintf("Usage: COMMAND -o FORMAT, for example 'iam-roles -o json', with FORMAT one of %v. Use 'output' to change the default output format.\n", outputFormats))
+			cursel = ""
+		case len(args) > 0:
+			cursel = args[0]
+		}
 		switch cursel {
+		case "":
+			// nothing to do, for example after a usage error
 		case "iam-user":
-			presult(formatCaller(ag))
+			if ag.Caller == nil {
+				pwarning("No info about the calling AWS identity available, see 'status' for details.\n")
+				break
+			}
+			if of == OutputText {
+				presult(formatCaller(ag))
+				break
+			}
+			res, err := render(of, callerView(ag))
+			if err != nil {
+				pwarning(fmt.Sprintf("Can't render caller: %v\n", err))
+				break
+			}
+			pformatted(of, res)
 		case "iam-roles":
 			targetrole := prompt.Input("  ↪ ", selectRole,
 				prompt.OptionMaxSuggestion(30),
 				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
-			if role, ok := ag.Roles[targetrole]; ok {
-				presult(formatRole(&role))
+			if _, ok := ag.Roles[targetrole]; ok {
+				pitem(of, "IAM role", targetrole)
 				appendhist("IAM role", targetrole)
 				if tracemode {
 					tracecntr++
@@ -64,8 +129,8 @@ func main() {
 			targetpolicy := prompt.Input("  ↪ ", selectPolicy,
 				prompt.OptionMaxSuggestion(30),
 				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
-			if policy, ok := ag.Policies[targetpolicy]; ok {
-				presult(formatPolicy(&policy))
+			if _, ok := ag.Policies[targetpolicy]; ok {
+				pitem(of, "IAM policy", targetpolicy)
 				appendhist("IAM policy", targetpolicy)
 				if tracemode {
 					tracecntr++
@@ -75,8 +140,8 @@ func main() {
 			targetsa := prompt.Input("  ↪ ", selectSA,
 				prompt.OptionMaxSuggestion(30),
 				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
-			if sa, ok := ag.ServiceAccounts[targetsa]; ok {
-				presult(formatSA(&sa))
+			if _, ok := ag.ServiceAccounts[targetsa]; ok {
+				pitem(of, "Kubernetes service account", targetsa)
 				appendhist("Kubernetes service account", targetsa)
 				if tracemode {
 					tracecntr++
@@ -86,36 +151,133 @@ func main() {
 			targetsec := prompt.Input("  ↪ ", selectSecret,
 				prompt.OptionMaxSuggestion(30),
 				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
-			if secret, ok := ag.Secrets[targetsec]; ok {
-				presult(formatSecret(&secret))
+			if _, ok := ag.Secrets[targetsec]; ok {
+				pitem(of, "Kubernetes secret", targetsec)
 				appendhist("Kubernetes secret", targetsec)
 				if tracemode {
 					tracecntr++
 				}
 			}
+		case "k8s-reveal":
+			targetsec := prompt.Input("  ↪ ", selectSecret,
+				prompt.OptionMaxSuggestion(30),
+				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
+			if _, ok := ag.Secrets[targetsec]; !ok {
+				break
+			}
+			targetkey := prompt.Input("  ↪ ", selectSecretKey(targetsec),
+				prompt.OptionMaxSuggestion(30),
+				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
+			v, err := revealSecret(ag, targetsec, targetkey)
+			if err != nil {
+				pwarning(fmt.Sprintf("Can't reveal secret: %v\n", err))
+				break
+			}
+			presult(v + "\n")
 		case "k8s-pods":
 			targetpod := prompt.Input("  ↪ ", selectPod,
 				prompt.OptionMaxSuggestion(30),
 				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
-			if pod, ok := ag.Pods[targetpod]; ok {
-				presult(formatPod(&pod))
+			if _, ok := ag.Pods[targetpod]; ok {
+				pitem(of, "Kubernetes pod", targetpod)
 				appendhist("Kubernetes pod", targetpod)
 				if tracemode {
 					tracecntr++
 				}
 			}
+		case "k8s-roles":
+			targetrole := prompt.Input("  ↪ ", selectKubeRole,
+				prompt.OptionMaxSuggestion(30),
+				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
+			if itype, ikey, ok := selectedKind(ag, kubeRoleKinds, targetrole); ok {
+				pitem(of, itype, ikey)
+				appendhist(itype, ikey)
+				if tracemode {
+					tracecntr++
+				}
+			}
+		case "k8s-bindings":
+			targetbinding := prompt.Input("  ↪ ", selectKubeBinding,
+				prompt.OptionMaxSuggestion(30),
+				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
+			if itype, ikey, ok := selectedKind(ag, kubeBindingKinds, targetbinding); ok {
+				pitem(of, itype, ikey)
+				appendhist(itype, ikey)
+				if tracemode {
+					tracecntr++
+				}
+			}
+		case "output":
+			targetformat := prompt.Input("  ↪ ", selectOutputFormat,
+				prompt.OptionMaxSuggestion(30),
+				prompt.OptionSuggestionBGColor(prompt.DarkBlue))
+			f, err := parseOutputFormat(targetformat)
+			if err != nil {
+				pwarning(fmt.Sprintf("%v\n", err))
+				break
+			}
+			outputformat = f
+			presult(fmt.Sprintf("Output format is now %v\n", outputformat))
 		case "history":
 			dumphist()
 		case "sync":
+			if offlineMode() {
+				pwarning("Can't sync in offline mode, the access graph has been loaded from a local dump and there are no live sources.\n")
+				pwarning("Unset RBIAM_OFFLINE and restart rbiam to gather info from IAM and Kubernetes.\n")
+				break
+			}
+			// by default we reuse the unchanged policy documents, 'sync full' starts from scratch:
+			full := len(args) > 1 && args[1] == "full"
 			fmt.Println("Gathering info from IAM and Kubernetes. This may take a bit, please stand by ...")
-			ag = NewAccessGraph(cfg)
+			iamsrcs, kubesrcs, err := newSources()
+			if err != nil {
+				pwarning(fmt.Sprintf("Can't sync, keeping the previous access graph: %v\n", err))
+				break
+			}
+			var newag *AccessGraph
+			var newreport *CollectionReport
+			if full || ag == nil {
+				newag, newreport = NewAccessGraph(iamsrcs, kubesrcs)
+			} else {
+				newag, newreport = ag.refresh(iamsrcs, kubesrcs)
+			}
+			if err := newreport.err(); err != nil {
+				// keep the report of the previous access graph, too, so that
+				// 'status' keeps describing the access graph we're using:
+				pwarning(fmt.Sprintf("Can't sync, keeping the previous access graph: %v\n", err))
+				break
+			}
+			prev := ag
+			ag, report = newag, newreport
+			presult(ag.summary())
+			if prev != nil {
+				presult(formatDeltas(deltas(prev, ag)))
+			}
+			if failures := formatFailures(newreport); failures != "" {
+				pwarning(failures)
+			}
+		case "status":
+			if report == nil {
+				presult("The access graph has been loaded from a local dump, there is no collection report.\n")
+				break
+			}
+			if of == OutputText {
+				presult(formatReport(report))
+				break
+			}
+			res, err := render(of, report)
+			if err != nil {
+				pwarning(fmt.Sprintf("Can't render status: %v\n", err))
+				break
+			}
+			pformatted(of, res)
 		case "trace":
 			tracemode = true
 			tracecntr = 0
 			presult("Starting to trace now. Use an 'export-xxx' command to stop tracing and export to one of the supported formats.\n")
 		case "export-raw":
 			tracemode = false
-			fn, err := exportRaw(history[0:tracecntr], ag)
+			fn, err := exportRaw(history[0:tracecntr], ag, includeSecrets(args))
 			if err != nil {
 				pwarning(fmt.Sprintf("Can't export trace: %v\n", err))
 				continue
@@ -133,28 +295,86 @@ func main() {
 			presult(fmt.Sprintf("\nThis is rbIAM in version %v\n\n", Version))
 			presult(strings.Repeat("-", 80))
 			presult("\nSelect one of the supported query commands:\n")
-			presult("- iam-user … to look up the calling AWS IAM user\n")
+			presult("- iam-user … to look up the calling AWS identity, an IAM user or an assumed role\n")
 			presult("- iam-roles … to look up an AWS IAM role by ARN\n")
 			presult("- iam-policies … to look up an AWS IAM policy by ARN\n")
 			presult("- k8s-sa … to look up an Kubernetes service account\n")
-			presult("- k8s-secrets … to look up a Kubernetes secret\n")
+			presult("- k8s-secrets … to look up a Kubernetes secret, with its values redacted\n")
+			presult("- k8s-reveal … to show the value of a single key of a Kubernetes secret\n")
 			presult("- k8s-pods … to look up a Kubernetes pod\n")
+			presult("- k8s-roles … to look up a Kubernetes role or cluster role\n")
+			presult("- k8s-bindings … to look up a Kubernetes role binding or cluster role binding\n")
+			presult("- output … to set the output format (text, json, yaml, table)\n")
 			presult("- history … show history\n")
-			presult("- sync … to refresh the local data\n")
+			presult("- sync … to refresh the local data, which re-lists all IAM and Kubernetes info and only reuses the documents of unchanged policies, and to show what changed; use 'sync full' to also re-fetch those (not available in offline mode)\n")
+			presult("- status … show which info could be collected and which not\n")
 			presult("- trace … start tracing\n")
-			presult("- export-raw … stop tracing and export trace to JSON dump in current working directory\n")
+			presult("- export-raw … stop tracing and export trace to JSON dump in current working directory, add --include-secrets to keep the payload of secrets\n")
 			presult("- export-graph … stop tracing and export trace as DOT file in current working directory\n")
+			presult("- diff DUMP [DUMP] … show the differences between a dump and the current access graph, or two dumps\n")
+			presult("- snapshots … list the dumps in the snapshot directory along with their accounts, contexts and capture time\n")
 			presult(strings.Repeat("-", 80))
 			presult("\n\nNote: simply start typing and/or use the tab and cursor keys to select.\n")
+			presult("Append '-o FORMAT' to a query command to override the output format, for example: iam-roles -o json\n")
 			presult("CTRL+L clears the screen and if you're stuck type 'help' or 'quit' to leave.\n\n")
 		case "quit":
 			presult("bye!\n")
 			os.Exit(0)
 		case "dump":
-			err := dump(ag)
+			fn, err := dump(ag, includeSecrets(args), argValue(args, "--name"))
 			if err != nil {
 				pwarning(fmt.Sprintf("Can't export access graph: %v\n", err))
+				continue
+			}
+			presult(fmt.Sprintf("Access graph exported to %v\n", fn))
+		case "snapshots":
+			dir := snapshotDir()
+			snapshots, err := listSnapshots(dir)
+			if err != nil {
+				pwarning(fmt.Sprintf("Can't list snapshots: %v\n", err))
+				break
+			}
+			if of == OutputText {
+				presult(formatSnapshots(dir, snapshots))
+				break
+			}
+			res, err := render(of, snapshots)
+			if err != nil {
+				pwarning(fmt.Sprintf("Can't render snapshots: %v\n", err))
+				break
+			}
+			pformatted(of, res)
+		case "diff":
+			// diff DUMP compares with the current access graph, diff DUMP DUMP two dumps:
+			if len(args) < 2 || len(args) > 3 {
+				pwarning("Usage: diff DUMP [DUMP]\n")
+				break
+			}
+			from, err := load(args[1])
+			if err != nil {
+				pwarning(fmt.Sprintf("Can't load %v: %v\n", args[1], err))
+				break
+			}
+			to, toname := ag, "current access graph"
+			if len(args) == 3 {
+				toname = args[2]
+				to, err = load(args[2])
+				if err != nil {
+					pwarning(fmt.Sprintf("Can't load %v: %v\n", args[2], err))
+					break
+				}
+			}
+			d := diffGraphs(from, to, args[1], toname)
+			if of == OutputText {
+				presult(formatDiff(d))
+				break
 			}
+			res, err := render(of, d)
+			if err != nil {
+				pwarning(fmt.Sprintf("Can't render diff: %v\n", err))
+				break
+			}
+			pformatted(of, res)
 		default:
 			presult("Not yet implemented, sorry\n")
 		}
@@ -168,8 +388,62 @@ func main() {
 	}
 }
 
+// offlineMode checks if the access graph is loaded from a local dump, as
+// selected via RBIAM_OFFLINE, rather than gathered from IAM and Kubernetes.
+// In offline mode neither AWS nor Kubernetes config is needed. Setting
+// RBIAM_OFFLINE to false, or anything else strconv.ParseBool() takes for
+// false such as 0, turns offline mode off, like leaving it unset does.
+func offlineMode() bool {
+	offline := os.Getenv("RBIAM_OFFLINE")
+	if b, err := strconv.ParseBool(offline); err == nil {
+		return b
+	}
+	return offline != ""
+}
+
+// awsConfig loads the AWS config on first use. Only collecting needs it,
+// so that commands working with dumps, such as keygen, snapshots or diffing
+// two dumps, work without AWS config, for example on an auditor's laptop
+// without AWS credentials.
+func awsConfig() (aws.Config, error) {
+	awscfg.once.Do(func() {
+		awscfg.cfg, awscfg.err = loadAWSConfig()
+	})
+	return awscfg.cfg, awscfg.err
+}
+
+// initAccessGraph sets up the access graph, either by loading it from a
+// local dump in offline mode or by gathering the info from IAM and Kubernetes.
+// In the latter case the access graph may be incomplete, see the report,
+// and an error means required info is missing.
+func initAccessGraph() (*AccessGraph, error) {
+	if offlineMode() {
+		fn, err := offlineDump(os.Getenv("RBIAM_OFFLINE"))
+		if err != nil {
+			return &AccessGraph{}, err
+		}
+		fmt.Fprintf(os.Stderr, "Loading IAM and Kubernetes info from local dump %v.\n", fn)
+		return load(fn)
+	}
+	fmt.Fprintln(os.Stderr, "Gathering info from IAM and Kubernetes. This may take a bit, please stand by.")
+	iamsrcs, kubesrcs, err := newSources()
+	if err != nil {
+		return &AccessGraph{}, err
+	}
+	newag, newreport := NewAccessGraph(iamsrcs, kubesrcs)
+	report = newreport
+	fmt.Fprint(os.Stderr, formatFailures(report))
+	return newag, report.err()
+}
+
 func appendhist(kind, entry string) {
-	history = append([]string{fmt.Sprintf("[%v] %v", kind, entry)}, history...)
+	history = append([]string{histitem(kind, entry)}, history...)
+}
+
+// histitem formats an item for the history and traces in the form
+// [TYPE] KEY, see also extractTK().
+func histitem(kind, entry string) string {
+	return fmt.Sprintf("[%v] %v", kind, entry)
 }
 
 func dumphist() {
@@ -187,6 +461,61 @@ func presult(msg string) {
 	_, _ = fmt.Fprintf(os.Stdout, "\x1b[34m%v\x1b[0m", msg)
 }
 
+// includeSecrets checks if the command arguments args ask for including
+// the payload of secrets in dumps and exports, which are stripped otherwise.
+func includeSecrets(args []string) bool {
+	for _, arg := range args {
+		if arg == "--include-secrets" {
+			return true
+		}
+	}
+	return false
+}
+
+// argValue returns the value of the option opt in the command arguments
+// args, for example the name in 'dump --name NAME', or an empty string.
+func argValue(args []string, opt string) string {
+	for i, arg := range args {
+		if arg == opt && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, opt+"=") {
+			return strings.TrimPrefix(arg, opt+"=")
+		}
+	}
+	return ""
+}
+
+// pprogress overwrites the current line on stderr with msg, which is useful
+// for long-running operations such as collecting the access graph, see
+// CollectionReport.progress(). Calling it with an
+// empty msg clears the line again. We use stderr to keep stdout clean for
+// results in non-interactive mode.
+func pprogress(msg string) {
+	_, _ = fmt.Fprintf(os.Stderr, "\r\x1b[2K%v", msg)
+}
+
+// pitem renders the item of type itype with the key ikey in the output
+// format of and writes it to stdout.
+func pitem(of OutputFormat, itype, ikey string) {
+	res, _, err := renderItem(ag, of, itype, ikey)
+	if err != nil {
+		pwarning(fmt.Sprintf("Can't render %v %v: %v\n", itype, ikey, err))
+		return
+	}
+	pformatted(of, res)
+}
+
+// pformatted writes msg to stdout, in blue for the text output format
+// and as-is for the machine-readable output formats.
+func pformatted(of OutputFormat, msg string) {
+	if of == OutputText {
+		presult(msg)
+		return
+	}
+	_, _ = fmt.Fprint(os.Stdout, msg)
+}
+
 // pwarning writes msg in red to stdout and note that you need to take
 // care of newlines yourself.
 func pwarning(msg string) {
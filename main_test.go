@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOfflineMode(t *testing.T) {
+	tests := []struct {
+		offline string
+		want    bool
+	}{
+		{"", false},
+		{"false", false},
+		{"0", false},
+		{"true", true},
+		{"1", true},
+		{"before-upgrade", true},
+		{"testdata/rbiam-dump.json", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("RBIAM_OFFLINE", tt.offline)
+		if got := offlineMode(); got != tt.want {
+			t.Errorf("got offline mode %v for RBIAM_OFFLINE=%q, want %v", got, tt.offline, tt.want)
+		}
+	}
+	os.Unsetenv("RBIAM_OFFLINE")
+	if offlineMode() {
+		t.Errorf("got offline mode without RBIAM_OFFLINE")
+	}
+}
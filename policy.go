@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// PolicyDocument represents an IAM policy document, see also:
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_policies_grammar.html
+type PolicyDocument struct {
+	// Version is the policy language version, for example 2012-10-17.
+	Version string `json:"Version,omitempty"`
+	// ID is the optional identifier of the policy.
+	ID string `json:"Id,omitempty"`
+	// Statement is the collection of statements the policy consists of.
+	Statement Statements `json:"Statement"`
+}
+
+// Statement is a single permission statement of a policy document.
+type Statement struct {
+	Sid          string     `json:"Sid,omitempty"`
+	Effect       string     `json:"Effect"`
+	Principal    Principal  `json:"Principal,omitempty"`
+	NotPrincipal Principal  `json:"NotPrincipal,omitempty"`
+	Action       StringList `json:"Action,omitempty"`
+	NotAction    StringList `json:"NotAction,omitempty"`
+	Resource     StringList `json:"Resource,omitempty"`
+	NotResource  StringList `json:"NotResource,omitempty"`
+	Condition    Condition  `json:"Condition,omitempty"`
+}
+
+// Principal maps principal types such as AWS, Service or Federated to
+// the respective principal identifiers, for example:
+// {"Service": ["ec2.amazonaws.com"]}
+type Principal map[string]StringList
+
+// UnmarshalJSON decodes both the wildcard principal "*", which we
+// represent as {"AWS": ["*"]}, and a map of principal types.
+func (p *Principal) UnmarshalJSON(b []byte) error {
+	var wildcard string
+	if err := json.Unmarshal(b, &wildcard); err == nil {
+		*p = Principal{"AWS": StringList{wildcard}}
+		return nil
+	}
+	m := map[string]StringList{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*p = m
+	return nil
+}
+
+// Condition maps condition operators such as StringEquals to
+// the condition keys and the values they are compared against.
+type Condition map[string]map[string]StringList
+
+// Statements is a list of statements. In a policy document this can be
+// either a single statement object or an array of statements.
+type Statements []Statement
+
+// UnmarshalJSON decodes both a single statement and a list of statements.
+func (s *Statements) UnmarshalJSON(b []byte) error {
+	var single Statement
+	if err := json.Unmarshal(b, &single); err == nil {
+		*s = Statements{single}
+		return nil
+	}
+	var multiple []Statement
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*s = multiple
+	return nil
+}
+
+// StringList is a list of strings. In a policy document this can be
+// either a single string or an array of strings. Condition values can also
+// be booleans or numbers, for example {"Bool": {"aws:SecureTransport": false}},
+// which we keep in their textual form, "false" in this case.
+type StringList []string
+
+// UnmarshalJSON decodes both a single value and a list of values.
+func (sl *StringList) UnmarshalJSON(b []byte) error {
+	var multiple []json.RawMessage
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		multiple = []json.RawMessage{b}
+	}
+	res := StringList{}
+	for _, raw := range multiple {
+		v, err := scalarString(raw)
+		if err != nil {
+			return err
+		}
+		res = append(res, v)
+	}
+	*sl = res
+	return nil
+}
+
+// scalarString decodes the JSON string, boolean or number raw into its
+// textual form, keeping numbers as written, for example 3600 or 1.5.
+func scalarString(raw json.RawMessage) (string, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case json.Number:
+		return v.String(), nil
+	}
+	return "", fmt.Errorf("expected a string, boolean or number, got %s", raw)
+}
+
+// PolicyParseError is the error for policy documents we retrieved but can't
+// make sense of, as opposed to documents we can't retrieve in the first place.
+type PolicyParseError struct {
+	Err error
+}
+
+// Error provides a textual rendering of the error.
+func (e *PolicyParseError) Error() string {
+	return fmt.Sprintf("can't parse policy document: %v", e.Err)
+}
+
+// parsePolicyDocument takes a URL-encoded policy document as returned
+// by IAM and turns it into a structured policy document.
+func parsePolicyDocument(encoded string) (*PolicyDocument, error) {
+	doc, err := url.QueryUnescape(encoded)
+	if err != nil {
+		return nil, &PolicyParseError{Err: err}
+	}
+	pd := &PolicyDocument{}
+	err = json.Unmarshal([]byte(doc), pd)
+	if err != nil {
+		return nil, &PolicyParseError{Err: err}
+	}
+	return pd, nil
+}
+
+// formatStatements provides a tabular rendering of the statements of a
+// policy document with one row per statement.
+func formatStatements(pd *PolicyDocument) string {
+	if pd == nil || len(pd.Statement) == 0 {
+		return "      n/a\n"
+	}
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "      #\tEffect\tAction\tResource\tCondition")
+	for i, stmt := range pd.Statement {
+		action := strings.Join(stmt.Action, ", ")
+		if len(stmt.NotAction) > 0 {
+			action = "NOT " + strings.Join(stmt.NotAction, ", ")
+		}
+		resource := strings.Join(stmt.Resource, ", ")
+		if len(stmt.NotResource) > 0 {
+			resource = "NOT " + strings.Join(stmt.NotResource, ", ")
+		}
+		_, _ = fmt.Fprintf(tw, "      %v\t%v\t%v\t%v\t%v\n",
+			i+1,
+			stmt.Effect,
+			action,
+			resource,
+			formatCondition(stmt.Condition),
+		)
+	}
+	_ = tw.Flush()
+	return b.String()
+}
+
+// formatCondition provides a compact textual rendering of a condition,
+// for example: StringEquals aws:RequestedRegion=eu-west-1
+func formatCondition(c Condition) string {
+	if len(c) == 0 {
+		return "-"
+	}
+	conds := []string{}
+	for op, kv := range c {
+		for k, v := range kv {
+			conds = append(conds, fmt.Sprintf("%v %v=%v", op, k, strings.Join(v, "|")))
+		}
+	}
+	sort.Strings(conds)
+	return strings.Join(conds, "; ")
+}
+
+// TrustRelationship describes who can assume a role, in terms of a single
+// principal taken from a statement of the role's trust policy.
+type TrustRelationship struct {
+	// Effect is either Allow or Deny.
+	Effect string
+	// PrincipalType is one of AWS, Service, Federated or CanonicalUser.
+	PrincipalType string
+	// Principal is the identifier of the principal, for example an ARN
+	// or a service name such as ec2.amazonaws.com.
+	Principal string
+	// Actions are the STS actions permitted, for example sts:AssumeRole
+	// or sts:AssumeRoleWithWebIdentity.
+	Actions []string
+	// Condition restricts when the principal can assume the role, for
+	// example for the subject of an OIDC token.
+	Condition Condition
+	// CrossAccount is true if the principal is in a different AWS account
+	// than the role, see roleTrust().
+	CrossAccount bool
+}
+
+// trustRelationships parses the URL-encoded trust policy (aka assume role
+// policy document) of a role into a list of trust relationships, one
+// per principal.
+func trustRelationships(trustpolicy string) ([]TrustRelationship, error) {
+	pd, err := parsePolicyDocument(trustpolicy)
+	if err != nil {
+		return nil, err
+	}
+	trs := []TrustRelationship{}
+	for _, stmt := range pd.Statement {
+		ptypes := []string{}
+		for ptype := range stmt.Principal {
+			ptypes = append(ptypes, ptype)
+		}
+		sort.Strings(ptypes)
+		for _, ptype := range ptypes {
+			for _, principal := range stmt.Principal[ptype] {
+				trs = append(trs, TrustRelationship{
+					Effect:        stmt.Effect,
+					PrincipalType: ptype,
+					Principal:     principal,
+					Actions:       stmt.Action,
+					Condition:     stmt.Condition,
+				})
+			}
+		}
+	}
+	return trs, nil
+}
+
+// formatTrustRelationships provides a textual rendering of trust
+// relationships with one line per principal.
+func formatTrustRelationships(trs []TrustRelationship) string {
+	if len(trs) == 0 {
+		return "\n      n/a"
+	}
+	var b strings.Builder
+	for _, tr := range trs {
+		b.WriteString(fmt.Sprintf("\n      %v %v %v via %v",
+			tr.Effect,
+			tr.PrincipalType,
+			tr.Principal,
+			strings.Join(tr.Actions, ", "),
+		))
+		if len(tr.Condition) > 0 {
+			b.WriteString(fmt.Sprintf(" if %v", formatCondition(tr.Condition)))
+		}
+		if tr.CrossAccount {
+			b.WriteString(" (cross-account)")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+)
+
+func TestParsePolicyDocumentConditions(t *testing.T) {
+	doc := `{
+		"Version": "2012-10-17",
+		"Statement": {
+			"Effect": "Deny",
+			"Action": "s3:*",
+			"Resource": ["arn:aws:s3:::bucket", "arn:aws:s3:::bucket/*"],
+			"Condition": {
+				"Bool": {"aws:SecureTransport": false},
+				"NumericLessThan": {"s3:TlsVersion": 1.2, "aws:MultiFactorAuthAge": [3600, "7200"]}
+			}
+		}
+	}`
+	pd, err := parsePolicyDocument(url.QueryEscape(doc))
+	if err != nil {
+		t.Fatalf("can't parse policy document: %v", err)
+	}
+	if len(pd.Statement) != 1 {
+		t.Fatalf("got %v statements, want 1", len(pd.Statement))
+	}
+	want := Condition{
+		"Bool":            {"aws:SecureTransport": {"false"}},
+		"NumericLessThan": {"s3:TlsVersion": {"1.2"}, "aws:MultiFactorAuthAge": {"3600", "7200"}},
+	}
+	if got := pd.Statement[0].Condition; !reflect.DeepEqual(got, want) {
+		t.Errorf("got condition %v, want %v", got, want)
+	}
+	if got := pd.Statement[0].Resource; len(got) != 2 {
+		t.Errorf("got resources %v, want two", got)
+	}
+}
+
+func TestParsePolicyDocumentInvalid(t *testing.T) {
+	for _, doc := range []string{
+		`{"Statement": {"Effect": "Allow", "Action": {"s3": "*"}}}`,
+		`{"Statement": {"Effect": "Allow", "Action": [null]}}`,
+		`not JSON`,
+	} {
+		_, err := parsePolicyDocument(url.QueryEscape(doc))
+		if _, ok := err.(*PolicyParseError); !ok {
+			t.Errorf("got error %v for %v, want a PolicyParseError", err, doc)
+		}
+	}
+}
+
+func TestTrustRelationshipsWithBoolCondition(t *testing.T) {
+	ag := fixtureGraph(t)
+	role := ag.Roles["arn:aws:iam::123456789012:role/eks-admin"]
+	trs, err := roleTrust(role)
+	if err != nil {
+		t.Fatalf("can't parse trust policy of eks-admin: %v", err)
+	}
+	if len(trs) != 1 || strings.Join(trs[0].Condition["Bool"]["aws:MultiFactorAuthPresent"], ",") != "true" {
+		t.Errorf("got trust relationships %+v, want one with aws:MultiFactorAuthPresent true", trs)
+	}
+}
+
+// unparsableDocument is an IAM source whose policy documents can't be
+// parsed, for the policy with the given ARN.
+type unparsableDocument struct {
+	*iamFixtures
+	policyarn string
+}
+
+func (src unparsableDocument) PolicyDocument(policy iam.Policy) (*PolicyDocument, error) {
+	if *policy.Arn == src.policyarn {
+		return parsePolicyDocument("{not JSON")
+	}
+	return src.iamFixtures.PolicyDocument(policy)
+}
+
+func TestPolicyDocumentsSkipUnparsable(t *testing.T) {
+	policyarn := "arn:aws:iam::123456789012:policy/eks-describe"
+	ag, report := NewAccessGraph(
+		map[string]IAMSource{"": unparsableDocument{newIAMFixtures(filepath.Join(fixtureDir, "iam")), policyarn}},
+		map[string]KubeSource{"": kubeFixtures{dir: filepath.Join(fixtureDir, "k8s")}},
+	)
+	if err := report.err(); err != nil {
+		t.Fatalf("got collection error %v, want none", err)
+	}
+	if _, ok := ag.PolicyDocuments[policyarn]; ok {
+		t.Errorf("got a document for %v, want none", policyarn)
+	}
+	if ag.PolicyDocumentErrors[policyarn] == "" {
+		t.Errorf("got no error recorded for %v", policyarn)
+	}
+	if len(ag.PolicyDocuments) != 2 {
+		t.Errorf("got %v policy documents, want the other 2", len(ag.PolicyDocuments))
+	}
+	policy := ag.Policies[policyarn]
+	if out := formatPolicy(&policy, nil, nil, ag.PolicyDocumentErrors[policyarn]); !strings.Contains(out, "can't parse policy document") {
+		t.Errorf("got rendering without the parse error:\n%v", out)
+	}
+}
+
+// deniedDocument is an IAM source that isn't allowed to get the document
+// of the policy with the given ARN.
+type deniedDocument struct {
+	*iamFixtures
+	policyarn string
+}
+
+func (src deniedDocument) PolicyDocument(policy iam.Policy) (*PolicyDocument, error) {
+	if *policy.Arn == src.policyarn {
+		return nil, fmt.Errorf("AccessDenied: not authorized to perform iam:GetPolicyVersion")
+	}
+	return src.iamFixtures.PolicyDocument(policy)
+}
+
+// noInstanceProfiles is an IAM source that isn't allowed to list instance
+// profiles.
+type noInstanceProfiles struct {
+	IAMSource
+}
+
+func (src noInstanceProfiles) InstanceProfiles() ([]iam.InstanceProfile, error) {
+	return nil, fmt.Errorf("AccessDenied: not authorized to perform iam:ListInstanceProfiles")
+}
+
+func TestPartialIAMCollection(t *testing.T) {
+	policyarn := "arn:aws:iam::123456789012:policy/eks-describe"
+	fixtures := newIAMFixtures(filepath.Join(fixtureDir, "iam"))
+	ag, report := NewAccessGraph(
+		map[string]IAMSource{"": noInstanceProfiles{deniedDocument{fixtures, policyarn}}},
+		map[string]KubeSource{"": kubeFixtures{dir: filepath.Join(fixtureDir, "k8s")}},
+	)
+	if err := report.err(); err != nil {
+		t.Fatalf("got collection error %v, want a usable access graph", err)
+	}
+	failed := []string{}
+	for _, cr := range report.failed() {
+		failed = append(failed, cr.Collector)
+	}
+	sort.Strings(failed)
+	if strings.Join(failed, ",") != "IAM instance profiles,IAM policy documents" {
+		t.Errorf("got failed collectors %v, want instance profiles and policy documents", failed)
+	}
+	if !strings.Contains(ag.PolicyDocumentErrors[policyarn], "AccessDenied") {
+		t.Errorf("got document error %q of %v, want access denied", ag.PolicyDocumentErrors[policyarn], policyarn)
+	}
+	if len(ag.PolicyDocuments) != 2 {
+		t.Errorf("got %v policy documents, want the other 2", len(ag.PolicyDocuments))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Permission represents the verbs a subject is allowed to use on a
+// resource, as granted by one or more role bindings or cluster role bindings.
+type Permission struct {
+	// Namespace is the namespace the permission applies to, or empty
+	// if the permission applies cluster-wide.
+	Namespace string `json:"namespace,omitempty"`
+	// APIGroup is the API group of the resource, empty for the core group.
+	APIGroup string `json:"apiGroup"`
+	// Resource is the resource, for example pods or secrets, or in case of
+	// a non-resource permission the URL, for example /healthz.
+	Resource string `json:"resource"`
+	// ResourceNames optionally restricts the permission to certain objects.
+	ResourceNames []string `json:"resourceNames,omitempty"`
+	// Verbs are the allowed verbs, for example get, list or watch.
+	Verbs []string `json:"verbs"`
+	// Via are the bindings granting the permission.
+	Via []string `json:"via"`
+}
+
+// saPermissions computes the effective permissions of the service account
+// with the given cluster, namespace and name, by aggregating the rules of all roles
+// and cluster roles bound to it. This takes into account bindings that
+// reference the service account directly as well as the ones referencing
+// the groups it's a member of, such as system:serviceaccounts:NAMESPACE.
+func (ag *AccessGraph) saPermissions(cluster, ns, name string) []Permission {
+	perms := make(map[string]*Permission)
+	grant := func(pns, binding string, rules []PolicyRule) {
+		for _, rule := range rules {
+			resources := rule.Resources
+			apigroups := rule.APIGroups
+			if len(rule.NonResourceURLs) > 0 {
+				resources = rule.NonResourceURLs
+				apigroups = []string{""}
+			}
+			for _, apigroup := range apigroups {
+				for _, resource := range resources {
+					k := strings.Join([]string{pns, apigroup, resource, strings.Join(rule.ResourceNames, ",")}, "|")
+					p, ok := perms[k]
+					if !ok {
+						p = &Permission{
+							Namespace:     pns,
+							APIGroup:      apigroup,
+							Resource:      resource,
+							ResourceNames: rule.ResourceNames,
+						}
+						perms[k] = p
+					}
+					p.Verbs = appendUnique(p.Verbs, rule.Verbs...)
+					p.Via = appendUnique(p.Via, binding)
+				}
+			}
+		}
+	}
+	for _, rb := range ag.KubeRoleBindings {
+		if rb.ClusterName != cluster || !bindsSA(rb.Subjects, rb.Namespace, ns, name) {
+			continue
+		}
+		binding := "RoleBinding " + namespaceit(rb.Namespace, rb.Name)
+		switch rb.RoleRef.Kind {
+		case "Role":
+			grant(rb.Namespace, binding, ag.KubeRoles[kubekey(cluster, rb.Namespace, rb.RoleRef.Name)].Rules)
+		case "ClusterRole":
+			grant(rb.Namespace, binding, ag.KubeClusterRoles[kubekey(cluster, "", rb.RoleRef.Name)].Rules)
+		}
+	}
+	for _, crb := range ag.KubeClusterRoleBindings {
+		if crb.ClusterName != cluster || !bindsSA(crb.Subjects, "", ns, name) {
+			continue
+		}
+		grant("", "ClusterRoleBinding "+crb.Name, ag.KubeClusterRoles[kubekey(cluster, "", crb.RoleRef.Name)].Rules)
+	}
+	res := []Permission{}
+	for _, p := range perms {
+		sort.Strings(p.Verbs)
+		sort.Strings(p.Via)
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Namespace != res[j].Namespace {
+			return res[i].Namespace < res[j].Namespace
+		}
+		if res[i].APIGroup != res[j].APIGroup {
+			return res[i].APIGroup < res[j].APIGroup
+		}
+		return res[i].Resource < res[j].Resource
+	})
+	return res
+}
+
+// bindsSA checks if any of the subjects of a binding in namespace bindingns
+// (empty for cluster role bindings) refers to the service account with the
+// given namespace and name, either directly or via one of its groups.
+func bindsSA(subjects []Subject, bindingns, ns, name string) bool {
+	for _, subject := range subjects {
+		switch subject.Kind {
+		case "ServiceAccount":
+			subjectns := subject.Namespace
+			if subjectns == "" {
+				subjectns = bindingns
+			}
+			if subjectns == ns && subject.Name == name {
+				return true
+			}
+		case "User":
+			if subject.Name == irsaSubjectPrefix+namespaceit(ns, name) {
+				return true
+			}
+		case "Group":
+			switch subject.Name {
+			case "system:serviceaccounts", "system:serviceaccounts:" + ns, "system:authenticated":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appendUnique appends the values to list that are not yet in it.
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// formatPermissions provides a tabular rendering of permissions with one
+// row per resource.
+func formatPermissions(perms []Permission) string {
+	if len(perms) == 0 {
+		return "      n/a\n"
+	}
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "      Namespace\tAPI group\tResource\tVerbs\tVia")
+	for _, p := range perms {
+		pns := p.Namespace
+		if pns == "" {
+			pns = "*"
+		}
+		resource := p.Resource
+		if len(p.ResourceNames) > 0 {
+			resource = fmt.Sprintf("%v (%v)", resource, strings.Join(p.ResourceNames, ","))
+		}
+		_, _ = fmt.Fprintf(tw, "      %v\t%q\t%v\t%v\t%v\n",
+			pns,
+			p.APIGroup,
+			resource,
+			strings.Join(p.Verbs, ","),
+			strings.Join(p.Via, ", "),
+		)
+	}
+	_ = tw.Flush()
+	return b.String()
+}
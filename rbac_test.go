@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSAPermissionsFromFixtures(t *testing.T) {
+	ag := fixtureGraph(t)
+	perms := ag.saPermissions("", "default", "s3-echoer")
+	if len(perms) != 1 {
+		t.Fatalf("got permissions %+v of default:s3-echoer, want reading pods", perms)
+	}
+	p := perms[0]
+	if p.Namespace != "default" || p.Resource != "pods" || strings.Join(p.Verbs, ",") != "get,list,watch" ||
+		strings.Join(p.Via, ",") != "RoleBinding default:read-pods" {
+		t.Errorf("got permission %+v, want reading pods in default via read-pods", p)
+	}
+	if perms := ag.saPermissions("", "default", "default"); len(perms) != 0 {
+		t.Errorf("got permissions %+v of default:default, want none", perms)
+	}
+}
+
+func TestSAPermissionsViaGroup(t *testing.T) {
+	ag := fixtureGraph(t)
+	crb := ag.KubeClusterRoleBindings["viewers"]
+	crb.Subjects = append(crb.Subjects, Subject{Kind: "Group", Name: "system:serviceaccounts:apps"})
+	ag.KubeClusterRoleBindings["viewers"] = crb
+	perms := ag.saPermissions("", "apps", "upload-images")
+	if len(perms) == 0 {
+		t.Fatalf("got no permissions of apps:upload-images, want the ones of view")
+	}
+	for _, p := range perms {
+		if p.Namespace != "" || strings.Join(p.Via, ",") != "ClusterRoleBinding viewers" {
+			t.Errorf("got permission %+v, want a cluster-wide one via viewers", p)
+		}
+	}
+	if perms := ag.saPermissions("", "default", "batch"); len(perms) != 0 {
+		t.Errorf("got permissions %+v of default:batch, want none", perms)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"sigs.k8s.io/yaml"
+)
+
+// OutputFormat is the format results are rendered in.
+type OutputFormat string
+
+const (
+	// OutputText is the human-readable, default format.
+	OutputText OutputFormat = "text"
+	// OutputJSON renders results as JSON.
+	OutputJSON OutputFormat = "json"
+	// OutputYAML renders results as YAML.
+	OutputYAML OutputFormat = "yaml"
+	// OutputTable renders results as tables, with a row per item for lists
+	// and a row per field otherwise.
+	OutputTable OutputFormat = "table"
+)
+
+// outputFormats lists the supported output formats.
+var outputFormats = []OutputFormat{OutputText, OutputJSON, OutputYAML, OutputTable}
+
+// parseOutputFormat turns the name of an output format into an
+// OutputFormat, failing for unsupported formats.
+func parseOutputFormat(name string) (OutputFormat, error) {
+	for _, of := range outputFormats {
+		if string(of) == strings.ToLower(name) {
+			return of, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported output format %q, use one of %v", name, outputFormats)
+}
+
+// extractOutputFormat looks for an --output FORMAT or -o FORMAT option in
+// args and returns the remaining arguments along with the output format,
+// which is defaultformat if no such option is present.
+func extractOutputFormat(args []string, defaultformat OutputFormat) ([]string, OutputFormat, error) {
+	remaining := []string{}
+	of := defaultformat
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--output" || args[i] == "-o":
+			if i+1 >= len(args) {
+				return nil, "", fmt.Errorf("missing value for %v", args[i])
+			}
+			i++
+			f, err := parseOutputFormat(args[i])
+			if err != nil {
+				return nil, "", err
+			}
+			of = f
+		case strings.HasPrefix(args[i], "--output="):
+			f, err := parseOutputFormat(strings.TrimPrefix(args[i], "--output="))
+			if err != nil {
+				return nil, "", err
+			}
+			of = f
+		default:
+			remaining = append(remaining, args[i])
+		}
+	}
+	return remaining, of, nil
+}
+
+// CallerView is the machine-readable representation of the calling identity,
+// which is either an IAM user or a role, for example when using AWS SSO.
+type CallerView struct {
+	Caller       *sts.GetCallerIdentityOutput `json:"caller"`
+	Type         string                       `json:"type,omitempty"`
+	User         *iam.User                    `json:"user,omitempty"`
+	RoleARN      string                       `json:"roleArn,omitempty"`
+	Role         *RoleView                    `json:"role,omitempty"`
+	Session      string                       `json:"session,omitempty"`
+	SSO          bool                         `json:"sso,omitempty"`
+	KubeIdentity []UserMapping                `json:"kubeIdentity,omitempty"`
+}
+
+// RoleView is the machine-readable representation of an IAM role.
+type RoleView struct {
+	Role         iam.Role            `json:"role"`
+	Policies     RolePolicies        `json:"policies"`
+	Trust        []TrustRelationship `json:"trust"`
+	IRSA         []IRSALink          `json:"irsa"`
+	KubeIdentity []RoleMapping       `json:"kubeIdentity,omitempty"`
+}
+
+// PolicyView is the machine-readable representation of an IAM policy.
+type PolicyView struct {
+	Policy        iam.Policy       `json:"policy"`
+	Attachments   map[string]int64 `json:"attachments,omitempty"`
+	Document      PolicyDocument   `json:"document"`
+	DocumentError string           `json:"documentError,omitempty"`
+}
+
+// ServiceAccountView is the machine-readable representation of a
+// Kubernetes service account.
+type ServiceAccountView struct {
+	ServiceAccount ServiceAccount `json:"serviceAccount"`
+	IRSA           []IRSALink     `json:"irsa"`
+	Permissions    []Permission   `json:"permissions"`
+}
+
+// PodView is the machine-readable representation of a Kubernetes pod.
+type PodView struct {
+	Pod         Pod    `json:"pod"`
+	AWSRole     string `json:"awsRole,omitempty"`
+	AWSRoleFrom string `json:"awsRoleFrom,omitempty"`
+}
+
+// callerView assembles the machine-readable representation of the caller.
+func callerView(ag *AccessGraph) CallerView {
+	cv := CallerView{Caller: ag.Caller, User: ag.User}
+	cv.Type, _, cv.Session = callerKind(*ag.Caller.Arn)
+	if ag.User != nil {
+		cv.KubeIdentity = ag.userMappings(*ag.User.Arn)
+	}
+	if rolearn, ok := ag.callerRoleARN(); ok {
+		cv.RoleARN = rolearn
+		cv.SSO = ag.isSSORole(rolearn)
+		if rv, ok := entity(ag, "IAM role", rolearn); ok {
+			role := rv.(RoleView)
+			cv.Role = &role
+		}
+	}
+	return cv
+}
+
+// entity assembles the machine-readable representation of the item of type
+// itype with the key ikey, using the same item types as the history, and
+// reports if the item exists in the access graph.
+func entity(ag *AccessGraph, itype, ikey string) (interface{}, bool) {
+	switch itype {
+	case "IAM role":
+		if role, ok := ag.Roles[ikey]; ok {
+			rv := RoleView{
+				Role:         role,
+				Policies:     ag.RolePolicies[ikey],
+				IRSA:         ag.irsaLinksOf(ikey),
+				KubeIdentity: ag.roleMappings(ikey),
+			}
+			rv.Trust, _ = roleTrust(role)
+			return rv, true
+		}
+	case "IAM policy":
+		if policy, ok := ag.Policies[ikey]; ok {
+			return PolicyView{
+				Policy:        policy,
+				Attachments:   ag.PolicyAttachments[ikey],
+				Document:      ag.PolicyDocuments[ikey],
+				DocumentError: ag.PolicyDocumentErrors[ikey],
+			}, true
+		}
+	case "Kubernetes service account":
+		if sa, ok := ag.ServiceAccounts[ikey]; ok {
+			return ServiceAccountView{
+				ServiceAccount: sa,
+				IRSA:           ag.irsaLinksOf(ikey),
+				Permissions:    ag.saPermissions(sa.ClusterName, sa.Namespace, sa.Name),
+			}, true
+		}
+	case "Kubernetes secret":
+		if secret, ok := ag.Secrets[ikey]; ok {
+			return redactedSecret(secret), true
+		}
+	case "Kubernetes pod":
+		if pod, ok := ag.Pods[ikey]; ok {
+			pv := PodView{Pod: pod}
+			pv.AWSRole, pv.AWSRoleFrom = ag.podRole(&pod)
+			return pv, true
+		}
+	case "Kubernetes role":
+		if role, ok := ag.KubeRoles[ikey]; ok {
+			return role, true
+		}
+	case "Kubernetes cluster role":
+		if crole, ok := ag.KubeClusterRoles[ikey]; ok {
+			return crole, true
+		}
+	case "Kubernetes role binding":
+		if rb, ok := ag.KubeRoleBindings[ikey]; ok {
+			return rb, true
+		}
+	case "Kubernetes cluster role binding":
+		if crb, ok := ag.KubeClusterRoleBindings[ikey]; ok {
+			return crb, true
+		}
+	}
+	return nil, false
+}
+
+// renderItem renders the item of type itype with the key ikey in the
+// output format of, and reports if the item exists in the access graph.
+func renderItem(ag *AccessGraph, of OutputFormat, itype, ikey string) (string, bool, error) {
+	if of == OutputText {
+		res, ok := describe(ag, itype, ikey)
+		return res, ok, nil
+	}
+	v, ok := entity(ag, itype, ikey)
+	if !ok {
+		return "", false, nil
+	}
+	res, err := render(of, v)
+	return res, true, err
+}
+
+// itemKeys returns the keys of all items of type itype in the access graph,
+// in alphabetical order.
+func itemKeys(ag *AccessGraph, itype string) []string {
+	keys := []string{}
+	add := func(m interface{}) {
+		for _, k := range reflect.ValueOf(m).MapKeys() {
+			keys = append(keys, k.String())
+		}
+	}
+	switch itype {
+	case "IAM role":
+		add(ag.Roles)
+	case "IAM policy":
+		add(ag.Policies)
+	case "Kubernetes service account":
+		add(ag.ServiceAccounts)
+	case "Kubernetes secret":
+		add(ag.Secrets)
+	case "Kubernetes pod":
+		add(ag.Pods)
+	case "Kubernetes role":
+		add(ag.KubeRoles)
+	case "Kubernetes cluster role":
+		add(ag.KubeClusterRoles)
+	case "Kubernetes role binding":
+		add(ag.KubeRoleBindings)
+	case "Kubernetes cluster role binding":
+		add(ag.KubeClusterRoleBindings)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// renderItems renders all items of type itype in the output format of: the
+// keys, one per line, as text and else a list of the items as entity()
+// assembles them, so scripts can consume entire collections.
+func renderItems(ag *AccessGraph, of OutputFormat, itype string) (string, error) {
+	keys := itemKeys(ag, itype)
+	if of == OutputText {
+		res := ""
+		for _, key := range keys {
+			res += key + "\n"
+		}
+		return res, nil
+	}
+	items := []interface{}{}
+	for _, key := range keys {
+		if v, ok := entity(ag, itype, key); ok {
+			items = append(items, v)
+		}
+	}
+	return render(of, items)
+}
+
+// render renders v in one of the machine-readable output formats.
+func render(of OutputFormat, v interface{}) (string, error) {
+	switch of {
+	case OutputJSON:
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(b) + "\n", nil
+	case OutputYAML:
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	case OutputTable:
+		return renderTable(v)
+	default:
+		return "", fmt.Errorf("can't render in output format %q", of)
+	}
+}
+
+// renderTable renders v as tables: a list of objects, such as the snapshots,
+// becomes a table with a row per object and a column per field, and so do
+// the lists of objects in an object, such as the collectors of a report or
+// the entities of a diff, titled with the name of the list. The remaining
+// fields of an object become a two-column table of fields and values. In
+// both cases nested fields are flattened into dotted paths such as
+// pod.metadata.name.
+func renderTable(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var generic interface{}
+	err = json.Unmarshal(b, &generic)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	switch val := generic.(type) {
+	case []interface{}:
+		writeRows(&sb, val)
+	case map[string]interface{}:
+		fields := make(map[string]interface{})
+		lists := []string{}
+		for k, child := range val {
+			if isObjectList(child) {
+				lists = append(lists, k)
+				continue
+			}
+			fields[k] = child
+		}
+		if len(fields) > 0 {
+			writeFields(&sb, fields)
+		}
+		sort.Strings(lists)
+		for _, k := range lists {
+			if sb.Len() > 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(strings.ToUpper(k) + "\n")
+			writeRows(&sb, val[k].([]interface{}))
+		}
+	default:
+		writeFields(&sb, generic)
+	}
+	return sb.String(), nil
+}
+
+// isObjectList checks if the generic JSON value v is a non-empty list of
+// objects, which we render with a row per object.
+func isObjectList(v interface{}) bool {
+	list, ok := v.([]interface{})
+	if !ok || len(list) == 0 {
+		return false
+	}
+	for _, elem := range list {
+		if _, ok := elem.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFields writes the generic JSON value v to sb as a two-column table
+// of fields and values.
+func writeFields(sb *strings.Builder, v interface{}) {
+	rows := make(map[string]string)
+	flatten("", v, rows)
+	fields := []string{}
+	for field := range rows {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	tw := tabwriter.NewWriter(sb, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "FIELD\tVALUE")
+	for _, field := range fields {
+		_, _ = fmt.Fprintf(tw, "%v\t%v\n", field, rows[field])
+	}
+	_ = tw.Flush()
+}
+
+// writeRows writes the generic JSON values in list to sb as a table with a
+// row per value and a column per field, across all values. Lists of plain
+// values within a value, such as the verbs of a permission, are joined
+// into a single column.
+func writeRows(sb *strings.Builder, list []interface{}) {
+	rows := []map[string]string{}
+	columns := []string{}
+	seen := make(map[string]bool)
+	for _, elem := range list {
+		row := make(map[string]string)
+		flattenRow("", elem, row)
+		for column := range row {
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, column)
+			}
+		}
+		rows = append(rows, row)
+	}
+	sort.Strings(columns)
+	tw := tabwriter.NewWriter(sb, 0, 4, 2, ' ', 0)
+	header := []string{}
+	for _, column := range columns {
+		header = append(header, strings.ToUpper(column))
+	}
+	_, _ = fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		values := []string{}
+		for _, column := range columns {
+			value := row[column]
+			if value == "" {
+				value = "-"
+			}
+			values = append(values, value)
+		}
+		_, _ = fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	_ = tw.Flush()
+}
+
+// flattenRow is like flatten, but joins lists of plain values, so they
+// fit into a single column.
+func flattenRow(path string, v interface{}, row map[string]string) {
+	list, ok := v.([]interface{})
+	if !ok {
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, child := range m {
+				if path != "" {
+					k = path + "." + k
+				}
+				flattenRow(k, child, row)
+			}
+			return
+		}
+		flatten(path, v, row)
+		return
+	}
+	values := []string{}
+	for _, elem := range list {
+		switch elem.(type) {
+		case map[string]interface{}, []interface{}:
+			flatten(path, v, row)
+			return
+		case nil:
+		default:
+			values = append(values, fmt.Sprintf("%v", elem))
+		}
+	}
+	row[path] = strings.Join(values, ", ")
+}
+
+// flatten walks the generic JSON value v and records leaf values in rows,
+// keyed by their dotted path.
+func flatten(path string, v interface{}, rows map[string]string) {
+	join := func(k string) string {
+		if path == "" {
+			return k
+		}
+		return path + "." + k
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			flatten(join(k), child, rows)
+		}
+	case []interface{}:
+		for i, child := range val {
+			flatten(join(fmt.Sprintf("%v", i)), child, rows)
+		}
+	case nil:
+	default:
+		rows[path] = fmt.Sprintf("%v", val)
+	}
+}
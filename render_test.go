@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRenderTableRows(t *testing.T) {
+	report := &CollectionReport{Results: []CollectorResult{
+		{Collector: "IAM roles", Required: true},
+		{Collector: "EC2 instances", Error: "access denied"},
+	}}
+	res, err := render(OutputTable, report)
+	if err != nil {
+		t.Fatalf("can't render report: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(res), "\n")
+	want := []string{
+		"FIELD     VALUE",
+		"duration  0",
+		"",
+		"RESULTS",
+		"COLLECTOR      DURATION  ERROR          REQUIRED",
+		"IAM roles      0         -              true",
+		"EC2 instances  0         access denied  -",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got table:\n%v\nwant:\n%v", res, strings.Join(want, "\n"))
+	}
+}
+
+func TestRenderTableList(t *testing.T) {
+	perms := []Permission{
+		{Namespace: "default", Resource: "pods", Verbs: []string{"get", "list"}, Via: []string{"RoleBinding default:read-pods"}},
+		{Resource: "/healthz", Verbs: []string{"get"}, Via: []string{"ClusterRoleBinding viewers"}},
+	}
+	res, err := render(OutputTable, perms)
+	if err != nil {
+		t.Fatalf("can't render permissions: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(res), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %v lines, want a header and a row per permission:\n%v", len(lines), res)
+	}
+	if !strings.HasPrefix(lines[0], "APIGROUP") || !strings.Contains(lines[1], "get, list") {
+		t.Errorf("got table:\n%v", res)
+	}
+}
+
+func TestRenderTableFields(t *testing.T) {
+	ag := fixtureGraph(t)
+	res, ok, err := renderItem(ag, OutputTable, "Kubernetes pod", "default:web-7d4c5b")
+	if err != nil || !ok {
+		t.Fatalf("can't render pod: %v", err)
+	}
+	if !strings.HasPrefix(res, "FIELD") || !strings.Contains(res, "pod.metadata.name") {
+		t.Errorf("got table:\n%v", res)
+	}
+}
+
+func TestExtractOutputFormat(t *testing.T) {
+	args, of, err := extractOutputFormat([]string{"iam-roles", "-o", "json"}, OutputText)
+	if err != nil || of != OutputJSON || len(args) != 1 || args[0] != "iam-roles" {
+		t.Errorf("got %v, %v, %v", args, of, err)
+	}
+	args, of, err = extractOutputFormat([]string{"-o", "json"}, OutputText)
+	if err != nil || of != OutputJSON || len(args) != 0 {
+		t.Errorf("got %v, %v, %v for a bare output format", args, of, err)
+	}
+	if _, _, err := extractOutputFormat([]string{"-o"}, OutputText); err == nil {
+		t.Errorf("got no error for a missing output format")
+	}
+	if _, _, err := extractOutputFormat([]string{"iam-roles", "--output=xml"}, OutputText); err == nil {
+		t.Errorf("got no error for an unsupported output format")
+	}
+}
+
+func TestRenderItems(t *testing.T) {
+	ag := fixtureGraph(t)
+	counts := map[string]int{
+		"role":            len(ag.Roles),
+		"policy":          len(ag.Policies),
+		"sa":              len(ag.ServiceAccounts),
+		"secret":          len(ag.Secrets),
+		"pod":             len(ag.Pods),
+		"k8s-role":        len(ag.KubeRoles),
+		"k8s-clusterrole": len(ag.KubeClusterRoles),
+		"binding":         len(ag.KubeRoleBindings),
+		"clusterbinding":  len(ag.KubeClusterRoleBindings),
+	}
+	for kind, itype := range itemKinds {
+		res, err := renderItems(ag, OutputJSON, itype)
+		if err != nil {
+			t.Errorf("can't render %v items: %v", kind, err)
+			continue
+		}
+		items := []map[string]interface{}{}
+		err = json.Unmarshal([]byte(res), &items)
+		if err != nil || len(items) != counts[kind] || len(items) == 0 {
+			t.Errorf("got %v %v items and error %v, want %v", len(items), kind, err, counts[kind])
+		}
+		res, err = renderItems(ag, OutputText, itype)
+		if err != nil || strings.Count(res, "\n") != counts[kind] {
+			t.Errorf("got keys %q and error %v for %v, want one per line", res, err, kind)
+		}
+		if _, err := renderItems(ag, OutputTable, itype); err != nil {
+			t.Errorf("can't render %v items as table: %v", kind, err)
+		}
+	}
+}
+
+func TestItemKindPlurals(t *testing.T) {
+	for kind, want := range map[string]string{
+		"roles":            "IAM role",
+		"policies":         "IAM policy",
+		"policy":           "IAM policy",
+		"sas":              "Kubernetes service account",
+		"k8s-clusterroles": "Kubernetes cluster role",
+		"clusterbindings":  "Kubernetes cluster role binding",
+	} {
+		if got, ok := itemKind(kind); !ok || got != want {
+			t.Errorf("got item type %q for %v, want %q", got, kind, want)
+		}
+	}
+	for _, kind := range []string{"rolez", "s", "user"} {
+		if got, ok := itemKind(kind); ok {
+			t.Errorf("got item type %q for unknown kind %v", got, kind)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collectorOrder is the order collectors are listed in a report, since
+// they run concurrently and finish in no particular order.
+var collectorOrder = []string{
+	"caller identity",
+	"IAM user",
+	"IAM roles",
+	"IAM role policies",
+	"IAM policies",
+	"IAM policy documents",
+	"IAM instance profiles",
+	"EC2 instances",
+	"Kubernetes identity",
+	"Kubernetes service accounts",
+	"Kubernetes secrets",
+	"Kubernetes pods",
+	"Kubernetes roles",
+	"Kubernetes cluster roles",
+	"Kubernetes role bindings",
+	"Kubernetes cluster role bindings",
+	"aws-auth config map",
+}
+
+// CollectorResult is the outcome of running a single collector.
+type CollectorResult struct {
+	// Collector is what has been collected, for example IAM roles.
+	Collector string `json:"collector"`
+	// Scope is the account or cluster the collector ran against, empty for
+	// the caller's own account and the single cluster, respectively.
+	Scope string `json:"scope,omitempty"`
+	// Required is true if the access graph is unusable without the info,
+	// which is the case for the IAM info of the caller's own account.
+	Required bool `json:"required,omitempty"`
+	// Error is the reason the collector failed, empty on success.
+	Error string `json:"error,omitempty"`
+	// Duration is how long the collector took.
+	Duration time.Duration `json:"duration"`
+}
+
+// CollectionReport captures which collectors succeeded and which failed
+// when building an access graph, and how long they took.
+type CollectionReport struct {
+	Results []CollectorResult `json:"results"`
+	// Duration is how long the collection took overall.
+	Duration time.Duration `json:"duration"`
+	// running are the collectors currently running, with their scope, for
+	// the progress line, see progress().
+	running map[string]int
+	// mu guards Results and running, since collectors run concurrently.
+	mu sync.Mutex
+}
+
+// run executes the collector fn and records its outcome. It's safe to call
+// run concurrently.
+func (r *CollectionReport) run(collector, scope string, required bool, fn func() error) error {
+	res := CollectorResult{Collector: collector, Scope: scope, Required: required}
+	name := collector + formatScope(scope)
+	r.mu.Lock()
+	if r.running == nil {
+		r.running = make(map[string]int)
+	}
+	r.running[name]++
+	r.progress()
+	r.mu.Unlock()
+	start := time.Now()
+	err := fn()
+	res.Duration = time.Since(start)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	r.mu.Lock()
+	r.Results = append(r.Results, res)
+	if r.running[name]--; r.running[name] == 0 {
+		delete(r.running, name)
+	}
+	r.progress()
+	r.mu.Unlock()
+	return err
+}
+
+// progress shows which collectors are done and which are still running, on
+// a single line, see pprogress(). Collectors run concurrently, so this is
+// the only place reporting progress, which keeps their updates from
+// interleaving on the line. The caller must hold r.mu.
+func (r *CollectionReport) progress() {
+	running := []string{}
+	for name := range r.running {
+		running = append(running, name)
+	}
+	sort.Strings(running)
+	if len(running) > 3 {
+		running = append(running[:3], "...")
+	}
+	pprogress(fmt.Sprintf("Collecting: %v done, %v running (%v)", len(r.Results), len(r.running), strings.Join(running, ", ")))
+}
+
+// finish records the overall duration of the collection, which started at
+// start, and orders the results by scope and collector.
+func (r *CollectionReport) finish(start time.Time) {
+	r.Duration = time.Since(start)
+	pprogress("")
+	rank := make(map[string]int)
+	for i, collector := range collectorOrder {
+		rank[collector] = i
+	}
+	sort.SliceStable(r.Results, func(i, j int) bool {
+		if r.Results[i].Scope != r.Results[j].Scope {
+			return r.Results[i].Scope < r.Results[j].Scope
+		}
+		return rank[r.Results[i].Collector] < rank[r.Results[j].Collector]
+	})
+}
+
+// failed returns the results of the collectors that failed.
+func (r *CollectionReport) failed() []CollectorResult {
+	res := []CollectorResult{}
+	for _, cr := range r.Results {
+		if cr.Error != "" {
+			res = append(res, cr)
+		}
+	}
+	return res
+}
+
+// err returns an error if any of the required collectors failed, which
+// means the access graph is unusable, and nil otherwise. Failures of other
+// collectors only mean the access graph is incomplete.
+func (r *CollectionReport) err() error {
+	msgs := []string{}
+	for _, cr := range r.failed() {
+		if cr.Required {
+			msgs = append(msgs, fmt.Sprintf("can't get %v: %v", cr.Collector, cr.Error))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v", strings.Join(msgs, "; "))
+}
+
+// formatFailures provides a textual rendering of the failed collectors,
+// one per line, or an empty string if all succeeded.
+func formatFailures(r *CollectionReport) string {
+	var b strings.Builder
+	for _, cr := range r.failed() {
+		b.WriteString(fmt.Sprintf("Can't get %v%v: %v\n", cr.Collector, formatScope(cr.Scope), cr.Error))
+	}
+	return b.String()
+}
+
+// formatReport provides a textual rendering of the health of the access
+// graph, with the status of each collector and how long it took.
+func formatReport(r *CollectionReport) string {
+	status := "healthy"
+	switch {
+	case r.err() != nil:
+		status = "failed, required info is missing"
+	case len(r.failed()) > 0:
+		status = "degraded, some info is missing"
+	}
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("     Status: %v\n     Duration: %v\n     Collectors:", status, r.Duration.Round(time.Millisecond)))
+	for _, cr := range r.Results {
+		outcome := "ok"
+		if cr.Error != "" {
+			outcome = "FAILED: " + cr.Error
+		}
+		b.WriteString(fmt.Sprintf("\n      %v%v: %v (%v)", cr.Collector, formatScope(cr.Scope), outcome, cr.Duration.Round(time.Millisecond)))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// formatScope provides a textual rendering of the scope of a collector.
+func formatScope(scope string) string {
+	if scope == "" {
+		return ""
+	}
+	return " in " + scope
+}
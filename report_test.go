@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportTracksRunningCollectors(t *testing.T) {
+	report := &CollectionReport{}
+	started := make(chan bool)
+	release := make(chan bool)
+	collector := func() error {
+		started <- true
+		<-release
+		return nil
+	}
+	go report.run("IAM roles", "", true, collector)
+	go report.run("IAM roles", "account 210987654321", false, collector)
+	<-started
+	<-started
+	report.mu.Lock()
+	running := len(report.running)
+	report.mu.Unlock()
+	if running != 2 {
+		t.Errorf("got %v running collectors, want 2", running)
+	}
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		report.mu.Lock()
+		done, running := len(report.Results), len(report.running)
+		report.mu.Unlock()
+		if done == 2 && running == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v done and %v running collectors, want all done", done, running)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	report.finish(time.Now())
+	if err := report.err(); err != nil {
+		t.Errorf("got error %v, want none", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// lastAppliedAnnotation is where kubectl apply keeps the last applied
+// configuration of an object, which for secrets includes their payload.
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// redactedAnnotation marks secrets whose payload has been stripped, for
+// example in dumps.
+const redactedAnnotation = "rbiam/redacted"
+
+// RedactedValue describes a secret value without revealing it.
+type RedactedValue struct {
+	// Size is the length of the value in bytes.
+	Size int `json:"size"`
+	// Fingerprint is a truncated HMAC-SHA-256 of the value, keyed with
+	// fingerprintKey, which allows to tell if two values are the same
+	// without showing them. Fingerprints can only be compared within the
+	// same rbiam process.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// fingerprintKey is the key of the fingerprints of redacted values, random
+// for each rbiam process. With a plain hash one could easily find short or
+// well-known values, for example passwords from a dictionary, from their
+// fingerprint, which tends to end up in shared output.
+var fingerprintKey = newFingerprintKey()
+
+// newFingerprintKey creates a random key for fingerprints.
+func newFingerprintKey() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(fmt.Sprintf("can't create fingerprint key: %v", err))
+	}
+	return key
+}
+
+// SecretView is the redacted rendering of a secret, with the keys of the
+// data but not the values.
+type SecretView struct {
+	ObjectMeta `json:"metadata,omitempty"`
+	Type       SecretType               `json:"type,omitempty"`
+	Data       map[string]RedactedValue `json:"data,omitempty"`
+	StringData map[string]RedactedValue `json:"stringData,omitempty"`
+	// Redacted is true if the payload isn't available at all, for example
+	// because the secret has been loaded from a dump without secrets.
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// redact describes the secret value v without revealing it.
+func redact(v []byte) RedactedValue {
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write(v)
+	return RedactedValue{Size: len(v), Fingerprint: "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:8])}
+}
+
+// redactedSecret provides the redacted view of the secret.
+func redactedSecret(secret Secret) SecretView {
+	sv := SecretView{
+		ObjectMeta: withoutPayloadAnnotations(secret.ObjectMeta),
+		Type:       secret.Type,
+		Redacted:   isRedacted(secret),
+	}
+	if len(secret.Data) > 0 {
+		sv.Data = make(map[string]RedactedValue)
+		for k, v := range secret.Data {
+			sv.Data[k] = redact(v)
+		}
+	}
+	if len(secret.StringData) > 0 {
+		sv.StringData = make(map[string]RedactedValue)
+		for k, v := range secret.StringData {
+			sv.StringData[k] = redact([]byte(v))
+		}
+	}
+	if sv.Redacted {
+		sv.Data, sv.StringData = redactedKeys(sv.Data), redactedKeys(sv.StringData)
+	}
+	return sv
+}
+
+// redactedKeys drops the sizes and fingerprints of stripped values, since
+// they describe the empty placeholders rather than the actual values.
+func redactedKeys(values map[string]RedactedValue) map[string]RedactedValue {
+	if values == nil {
+		return nil
+	}
+	res := make(map[string]RedactedValue)
+	for k := range values {
+		res[k] = RedactedValue{}
+	}
+	return res
+}
+
+// withoutPayloadAnnotations returns a copy of the metadata without the
+// annotations that might contain the payload of the secret.
+func withoutPayloadAnnotations(meta ObjectMeta) ObjectMeta {
+	if _, ok := meta.Annotations[lastAppliedAnnotation]; !ok {
+		return meta
+	}
+	annotations := make(map[string]string)
+	for k, v := range meta.Annotations {
+		if k != lastAppliedAnnotation {
+			annotations[k] = v
+		}
+	}
+	meta.Annotations = annotations
+	return meta
+}
+
+// isRedacted checks if the payload of the secret has been stripped.
+func isRedacted(secret Secret) bool {
+	return secret.Annotations[redactedAnnotation] == "true"
+}
+
+// stripSecret returns a copy of the secret without its payload, keeping
+// the keys so one can still see what the secret holds.
+func stripSecret(secret Secret) Secret {
+	stripped := Secret{
+		ObjectMeta: withoutPayloadAnnotations(secret.ObjectMeta),
+		Type:       secret.Type,
+	}
+	annotations := map[string]string{redactedAnnotation: "true"}
+	for k, v := range stripped.Annotations {
+		annotations[k] = v
+	}
+	stripped.Annotations = annotations
+	if len(secret.Data) > 0 {
+		stripped.Data = make(map[string][]byte)
+		for k := range secret.Data {
+			stripped.Data[k] = nil
+		}
+	}
+	if len(secret.StringData) > 0 {
+		stripped.StringData = make(map[string]string)
+		for k := range secret.StringData {
+			stripped.StringData[k] = ""
+		}
+	}
+	return stripped
+}
+
+// marshalGraph encodes the access graph as JSON, stripping the payload of
+// all secrets unless withsecrets is true.
+func marshalGraph(ag *AccessGraph, withsecrets bool) ([]byte, error) {
+	b, err := json.Marshal(ag)
+	if err != nil || withsecrets {
+		return b, err
+	}
+	fields := make(map[string]json.RawMessage)
+	err = json.Unmarshal(b, &fields)
+	if err != nil {
+		return nil, err
+	}
+	stripped := make(map[string]Secret)
+	for key, secret := range ag.Secrets {
+		stripped[key] = stripSecret(secret)
+	}
+	fields["Secrets"], err = json.Marshal(stripped)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// secretKeys returns the keys of the data and string data of the secret,
+// in alphabetical order.
+func secretKeys(secret Secret) []string {
+	keys := []string{}
+	for k := range secret.Data {
+		keys = append(keys, k)
+	}
+	for k := range secret.StringData {
+		if _, ok := secret.Data[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// revealSecret returns the value of a single key of the secret with the
+// given key in the access graph. This is the only way to see the payload
+// of a secret, everything else shows redacted values.
+func revealSecret(ag *AccessGraph, seckey, datakey string) (string, error) {
+	secret, ok := ag.Secrets[seckey]
+	if !ok {
+		return "", fmt.Errorf("no secret %v found", seckey)
+	}
+	if isRedacted(secret) {
+		return "", fmt.Errorf("the payload of secret %v has been stripped from the dump", seckey)
+	}
+	if v, ok := secret.Data[datakey]; ok {
+		return string(v), nil
+	}
+	if v, ok := secret.StringData[datakey]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("secret %v has no key %v", seckey, datakey)
+}
+
+// formatRedactedValues provides a textual rendering of redacted values,
+// one per line, in the order of the keys.
+func formatRedactedValues(values map[string]RedactedValue, redacted bool) string {
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := ""
+	for _, k := range keys {
+		if redacted {
+			res += fmt.Sprintf("\n      %v: <stripped>", k)
+			continue
+		}
+		res += fmt.Sprintf("\n      %v: <redacted, %v bytes, %v>", k, values[k].Size, values[k].Fingerprint)
+	}
+	return res
+}
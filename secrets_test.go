@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRedactFingerprint(t *testing.T) {
+	a, b := redact([]byte("hunter2")), redact([]byte("hunter2"))
+	if a != b {
+		t.Errorf("got fingerprints %v and %v of the same value, want them equal", a.Fingerprint, b.Fingerprint)
+	}
+	if c := redact([]byte("hunter3")); c.Fingerprint == a.Fingerprint {
+		t.Errorf("got the same fingerprint %v for different values", c.Fingerprint)
+	}
+	if a.Size != 7 {
+		t.Errorf("got size %v, want 7", a.Size)
+	}
+	sum := sha256.Sum256([]byte("hunter2"))
+	if strings.Contains(a.Fingerprint, hex.EncodeToString(sum[:8])) {
+		t.Errorf("got fingerprint %v, the plain SHA-256 hash of the value", a.Fingerprint)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// legacyOfflineDump is the dump offline mode used to load, before dumps
+// could be selected, and is still used if RBIAM_OFFLINE is set to true.
+const legacyOfflineDump = "rbiam-offline.json"
+
+// dumpFilename matches the names of dumps, which are 'rbiam-dump-' followed
+// by the Unix timestamp of the creation time and optionally the name of the
+// snapshot, for example: rbiam-dump-1564315687-before-upgrade.json
+var dumpFilename = regexp.MustCompile(`^rbiam-dump-([0-9]+)(?:-([A-Za-z0-9][A-Za-z0-9._-]*))?\.json$`)
+
+// snapshotName matches valid names of snapshots.
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// SnapshotInfo describes when and where a dump has been captured, so one
+// can tell dumps apart without looking at the entire access graph.
+type SnapshotInfo struct {
+	// Name is the optional name of the snapshot, for example 'before-upgrade'.
+	Name string `json:"name,omitempty"`
+	// CapturedAt is the time the dump has been taken.
+	CapturedAt time.Time `json:"capturedAt"`
+	// Accounts are the IDs of the AWS accounts in the dump.
+	Accounts []string `json:"accounts,omitempty"`
+	// Contexts are the kube contexts of the clusters in the dump.
+	Contexts []string `json:"contexts,omitempty"`
+}
+
+// Snapshot is a dump in a directory, as listed by the snapshots command.
+type Snapshot struct {
+	// File is the path of the dump.
+	File string `json:"file"`
+	SnapshotInfo
+	// Format is the format of the dump, before any migration, and
+	// RbiamVersion the version of rbiam that wrote it, if known.
+	Format       int    `json:"format"`
+	RbiamVersion string `json:"rbiamVersion,omitempty"`
+	// Encrypted is true if the dump is encrypted.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Error is why the dump couldn't be read, in which case only the name
+	// and the capture time, from the file name, are available.
+	Error string `json:"error,omitempty"`
+}
+
+// snapshotDir returns the directory dumps are written to and looked up in,
+// as set via the RBIAM_SNAPSHOT_DIR environment variable, defaulting to the
+// current working directory.
+func snapshotDir() string {
+	if dir := os.Getenv("RBIAM_SNAPSHOT_DIR"); dir != "" {
+		return dir
+	}
+	return "."
+}
+
+// snapshotFilename returns the file name of a dump taken at t, with name
+// being the optional name of the snapshot.
+func snapshotFilename(name string, t time.Time) string {
+	if name == "" {
+		return fmt.Sprintf("rbiam-dump-%v.json", t.Unix())
+	}
+	return fmt.Sprintf("rbiam-dump-%v-%v.json", t.Unix(), name)
+}
+
+// validateSnapshotName checks if name can be used as the name of a snapshot,
+// which becomes part of the file name.
+func validateSnapshotName(name string) error {
+	if name != "" && !snapshotName.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q, use letters, digits, '.', '_' and '-' only", name)
+	}
+	return nil
+}
+
+// snapshotInfo describes the access graph ag, for a dump taken now.
+func snapshotInfo(ag *AccessGraph, name string) *SnapshotInfo {
+	info := &SnapshotInfo{Name: name, CapturedAt: time.Now().UTC().Truncate(time.Second)}
+	for account := range ag.Accounts {
+		info.Accounts = append(info.Accounts, account)
+	}
+	sort.Strings(info.Accounts)
+	info.Contexts = kubeContextsOf(ag.KubeContexts, ag.KubeConfig)
+	return info
+}
+
+// kubeContextsOf returns the kube contexts of an access graph with the given
+// contexts, for several clusters, and kubeconfig, for a single cluster.
+func kubeContextsOf(kubecontexts []string, kubeconfig *Config) []string {
+	if len(kubecontexts) > 0 {
+		return append([]string{}, kubecontexts...)
+	}
+	if kubeconfig != nil && kubeconfig.CurrentContext != "" {
+		return []string{kubeconfig.CurrentContext}
+	}
+	return nil
+}
+
+// dumpFiles returns the paths of the dumps in dir with the given snapshot
+// name, or all dumps for an empty name, latest first.
+func dumpFiles(dir, name string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type dumpfile struct {
+		path string
+		ts   int64
+	}
+	dfs := []dumpfile{}
+	for _, e := range entries {
+		m := dumpFilename.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil || (name != "" && m[2] != name) {
+			continue
+		}
+		ts, _ := strconv.ParseInt(m[1], 10, 64)
+		dfs = append(dfs, dumpfile{path: filepath.Join(dir, e.Name()), ts: ts})
+	}
+	sort.Slice(dfs, func(i, j int) bool {
+		if dfs[i].ts != dfs[j].ts {
+			return dfs[i].ts > dfs[j].ts
+		}
+		return dfs[i].path > dfs[j].path
+	})
+	paths := []string{}
+	for _, df := range dfs {
+		paths = append(paths, df.path)
+	}
+	return paths, nil
+}
+
+// latestDump returns the path of the latest dump in dir with the given
+// snapshot name, or of any dump for an empty name.
+func latestDump(dir, name string) (string, error) {
+	paths, err := dumpFiles(dir, name)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		if name != "" {
+			return "", fmt.Errorf("no snapshot named %v found in %v", name, dir)
+		}
+		return "", fmt.Errorf("no dumps found in %v", dir)
+	}
+	return paths[0], nil
+}
+
+// offlineDump resolves the value of RBIAM_OFFLINE to the path of the dump
+// to load, which can be:
+//
+//   - the path of a dump
+//   - a directory, in which case the latest dump in it is used
+//   - the name of a snapshot in the snapshot directory, see snapshotDir()
+//   - true, for rbiam-offline.json or else the latest dump in the snapshot
+//     directory
+func offlineDump(offline string) (string, error) {
+	if fi, err := os.Stat(offline); err == nil {
+		if fi.IsDir() {
+			return latestDump(offline, "")
+		}
+		return offline, nil
+	}
+	if b, err := strconv.ParseBool(offline); err == nil && b {
+		if _, err := os.Stat(legacyOfflineDump); err == nil {
+			return legacyOfflineDump, nil
+		}
+		return latestDump(snapshotDir(), "")
+	}
+	if snapshotName.MatchString(offline) {
+		if fn, err := latestDump(snapshotDir(), offline); err == nil {
+			return fn, nil
+		}
+	}
+	return "", fmt.Errorf("RBIAM_OFFLINE=%v is neither a dump, a directory with dumps nor the name of a snapshot in %v", offline, snapshotDir())
+}
+
+// listSnapshots describes the dumps in dir, latest first. Encrypted dumps are
+// decrypted if possible, see decryptIfNeeded(), to read their metadata.
+func listSnapshots(dir string) ([]Snapshot, error) {
+	paths, err := dumpFiles(dir, "")
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []Snapshot{}
+	for _, path := range paths {
+		snapshots = append(snapshots, readSnapshot(path))
+	}
+	return snapshots, nil
+}
+
+// readSnapshot describes the dump at path. For dumps without metadata, it
+// falls back to the file name, see migrateLegacyDump() for the rest.
+func readSnapshot(path string) Snapshot {
+	s := Snapshot{File: path}
+	m := dumpFilename.FindStringSubmatch(filepath.Base(path))
+	if m != nil {
+		ts, _ := strconv.ParseInt(m[1], 10, 64)
+		s.CapturedAt = time.Unix(ts, 0).UTC()
+		s.Name = m[2]
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Encrypted = isEncrypted(b)
+	b, err = decryptIfNeeded(b)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	// the format before migrating, with dumps that predate the envelope
+	// having none, that is format 0:
+	var format struct {
+		Format int `json:"format"`
+	}
+	_ = json.Unmarshal(b, &format)
+	s.Format = format.Format
+	env, err := decodeDump(b)
+	if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	// dumps that predate the metadata only have the capture time and the
+	// name in their file name:
+	name, captured := s.Name, s.CapturedAt
+	s.SnapshotInfo = env.SnapshotInfo
+	if s.Name == "" {
+		s.Name = name
+	}
+	if s.CapturedAt.IsZero() {
+		s.CapturedAt = captured
+	}
+	s.RbiamVersion = env.RbiamVersion
+	return s
+}
+
+// formatSnapshots provides a textual rendering of the dumps in dir, one per
+// line, latest first.
+func formatSnapshots(dir string, snapshots []Snapshot) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("     Directory: %v\n     Snapshots:", dir))
+	if len(snapshots) == 0 {
+		b.WriteString(" none\n")
+		return b.String()
+	}
+	for _, s := range snapshots {
+		details := []string{}
+		if s.Name != "" {
+			details = append(details, "name "+s.Name)
+		}
+		details = append(details, "captured "+s.CapturedAt.Format(time.RFC3339))
+		if len(s.Accounts) > 0 {
+			details = append(details, "accounts "+strings.Join(s.Accounts, ", "))
+		}
+		if len(s.Contexts) > 0 {
+			details = append(details, "contexts "+strings.Join(s.Contexts, ", "))
+		}
+		if s.Error == "" {
+			format := fmt.Sprintf("format %v", s.Format)
+			if s.RbiamVersion != "" {
+				format += " by rbiam " + s.RbiamVersion
+			}
+			details = append(details, format)
+		}
+		if s.Encrypted {
+			details = append(details, "encrypted")
+		}
+		if s.Error != "" {
+			details = append(details, "can't read: "+s.Error)
+		}
+		b.WriteString(fmt.Sprintf("\n      %v: %v", filepath.Base(s.File), strings.Join(details, "; ")))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// IAMSource provides the IAM-related info the access graph is built from.
+// Besides IAM this includes STS for the caller and EC2 for the instances.
+type IAMSource interface {
+	// CallerIdentity returns the identity of the caller.
+	CallerIdentity() (*sts.GetCallerIdentityOutput, error)
+	// User returns the IAM user issuing the requests.
+	User() (*iam.User, error)
+	// Roles returns all IAM roles.
+	Roles() ([]iam.Role, error)
+	// RolePolicies returns the managed and inline policies of the role.
+	RolePolicies(role iam.Role) (RolePolicies, error)
+	// Policies returns all attached IAM policies.
+	Policies() ([]iam.Policy, error)
+	// PolicyDocument returns the document of the default version of the policy.
+	PolicyDocument(policy iam.Policy) (*PolicyDocument, error)
+	// InstanceProfiles returns all IAM instance profiles.
+	InstanceProfiles() ([]iam.InstanceProfile, error)
+	// Instances returns all EC2 instances.
+	Instances() ([]ec2.Instance, error)
+}
+
+// KubeSource provides the Kubernetes-related info the access graph is built from.
+type KubeSource interface {
+	// Config returns the Kubernetes client configuration.
+	Config() (*Config, error)
+	// ServiceAccounts returns the service accounts in all namespaces.
+	ServiceAccounts() ([]ServiceAccount, error)
+	// Secrets returns the secrets in all namespaces.
+	Secrets() ([]Secret, error)
+	// Pods returns the pods in all namespaces.
+	Pods() ([]Pod, error)
+	// Roles returns the roles in all namespaces.
+	Roles() ([]Role, error)
+	// ClusterRoles returns the cluster roles.
+	ClusterRoles() ([]ClusterRole, error)
+	// RoleBindings returns the role bindings in all namespaces.
+	RoleBindings() ([]RoleBinding, error)
+	// ClusterRoleBindings returns the cluster role bindings.
+	ClusterRoleBindings() ([]ClusterRoleBinding, error)
+	// ConfigMap returns the config map with the given namespace and name.
+	ConfigMap(namespace, name string) (*ConfigMap, error)
+}
+
+// newSources sets up the IAM sources, keyed by how the account is accessed,
+// and the Kubernetes sources, keyed by cluster name. If the RBIAM_FIXTURES
+// environment variable points to a fixture directory we use it, otherwise
+// we use the live AWS and Kubernetes sources, see iamSources() and
+// kubeSources() for how to select accounts and clusters. All sources share
+// a bound on concurrent requests, see collectionParallelism(). Only the
+// live sources need the AWS config, see awsConfig().
+func newSources() (map[string]IAMSource, map[string]KubeSource, error) {
+	if dir := os.Getenv("RBIAM_FIXTURES"); dir != "" {
+		iamsrcs, kubesrcs := limitSources(
+			map[string]IAMSource{"": newIAMFixtures(filepath.Join(dir, "iam"))},
+			map[string]KubeSource{"": kubeFixtures{dir: filepath.Join(dir, "k8s")}},
+			collectionParallelism())
+		return iamsrcs, kubesrcs, nil
+	}
+	cfg, err := awsConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't load AWS config: %v", err)
+	}
+	cfg = withRetries(cfg)
+	iamsrcs, kubesrcs := limitSources(iamSources(cfg), kubeSources(cfg), collectionParallelism())
+	return iamsrcs, kubesrcs, nil
+}
+
+// readFixture decodes the JSON file at path into v. A missing file is
+// not an error, it simply leaves v untouched and returns false.
+func readFixture(path string, v interface{}) (bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return false, fmt.Errorf("can't decode fixture %v: %v", path, err)
+	}
+	return true, nil
+}
+
+// iamFixtures is an IAM source backed by JSON files in a directory:
+//
+//	caller.json            the STS caller identity
+//	user.json              the IAM user
+//	roles.json             a list of IAM roles
+//	role-policies.json     the policies attached to roles, keyed by role ARN
+//	policies.json          a list of IAM policies
+//	policy-documents.json  the policy documents, keyed by policy ARN
+//	instance-profiles.json a list of IAM instance profiles
+//	instances.json         a list of EC2 instances
+//
+// Only caller.json is required, and user.json if the caller is an IAM user,
+// all other missing files are treated as empty collections. The policies of
+// roles and the policy documents are looked up per role and policy, so we
+// read those files only once, see load().
+type iamFixtures struct {
+	dir  string
+	once sync.Once
+	rps  map[string]RolePolicies
+	pds  map[string]PolicyDocument
+	err  error
+}
+
+// newIAMFixtures creates an IAM source backed by the fixtures in dir.
+func newIAMFixtures(dir string) *iamFixtures {
+	return &iamFixtures{dir: dir}
+}
+
+// load reads role-policies.json and policy-documents.json, on first use.
+func (src *iamFixtures) load() error {
+	src.once.Do(func() {
+		src.rps = make(map[string]RolePolicies)
+		src.pds = make(map[string]PolicyDocument)
+		_, src.err = readFixture(filepath.Join(src.dir, "role-policies.json"), &src.rps)
+		if src.err != nil {
+			return
+		}
+		_, src.err = readFixture(filepath.Join(src.dir, "policy-documents.json"), &src.pds)
+	})
+	return src.err
+}
+
+// CallerIdentity reads the caller identity from caller.json.
+func (src *iamFixtures) CallerIdentity() (*sts.GetCallerIdentityOutput, error) {
+	caller := &sts.GetCallerIdentityOutput{}
+	found, err := readFixture(filepath.Join(src.dir, "caller.json"), caller)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no caller.json in fixture directory %v", src.dir)
+	}
+	return caller, nil
+}
+
+// User reads the IAM user from user.json.
+func (src *iamFixtures) User() (*iam.User, error) {
+	user := &iam.User{}
+	found, err := readFixture(filepath.Join(src.dir, "user.json"), user)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no user.json in fixture directory %v", src.dir)
+	}
+	return user, nil
+}
+
+// Roles reads the IAM roles from roles.json.
+func (src *iamFixtures) Roles() ([]iam.Role, error) {
+	roles := []iam.Role{}
+	_, err := readFixture(filepath.Join(src.dir, "roles.json"), &roles)
+	return roles, err
+}
+
+// RolePolicies looks up the policies of the role in role-policies.json.
+func (src *iamFixtures) RolePolicies(role iam.Role) (RolePolicies, error) {
+	err := src.load()
+	if err != nil {
+		return RolePolicies{}, err
+	}
+	return src.rps[*role.Arn], nil
+}
+
+// Policies reads the IAM policies from policies.json.
+func (src *iamFixtures) Policies() ([]iam.Policy, error) {
+	policies := []iam.Policy{}
+	_, err := readFixture(filepath.Join(src.dir, "policies.json"), &policies)
+	return policies, err
+}
+
+// PolicyDocument looks up the document of the policy in policy-documents.json.
+// Unlike a role without policies, a policy without document is an error, as
+// IAM always has one.
+func (src *iamFixtures) PolicyDocument(policy iam.Policy) (*PolicyDocument, error) {
+	err := src.load()
+	if err != nil {
+		return nil, err
+	}
+	pd, ok := src.pds[*policy.Arn]
+	if !ok {
+		return nil, fmt.Errorf("no document of policy %v in policy-documents.json in fixture directory %v", *policy.Arn, src.dir)
+	}
+	return &pd, nil
+}
+
+// InstanceProfiles reads the IAM instance profiles from instance-profiles.json.
+func (src *iamFixtures) InstanceProfiles() ([]iam.InstanceProfile, error) {
+	profiles := []iam.InstanceProfile{}
+	_, err := readFixture(filepath.Join(src.dir, "instance-profiles.json"), &profiles)
+	return profiles, err
+}
+
+// Instances reads the EC2 instances from instances.json.
+func (src *iamFixtures) Instances() ([]ec2.Instance, error) {
+	instances := []ec2.Instance{}
+	_, err := readFixture(filepath.Join(src.dir, "instances.json"), &instances)
+	return instances, err
+}
+
+// kubeFixtures is a Kubernetes source backed by JSON files in a directory,
+// in the format 'kubectl get ... --all-namespaces --output json' produces:
+//
+//	kubeconfig.json           the output of 'kubectl config view --minify --output json'
+//	serviceaccounts.json      a list of service accounts
+//	secrets.json              a list of secrets
+//	pods.json                 a list of pods
+//	roles.json                a list of roles
+//	clusterroles.json         a list of cluster roles
+//	rolebindings.json         a list of role bindings
+//	clusterrolebindings.json  a list of cluster role bindings
+//	configmap-NS-NAME.json    the config map NAME in namespace NS
+//
+// Missing files are treated as empty collections.
+type kubeFixtures struct {
+	dir string
+}
+
+// Config reads the Kubernetes client configuration from kubeconfig.json.
+func (src kubeFixtures) Config() (*Config, error) {
+	kconf := &Config{}
+	_, err := readFixture(filepath.Join(src.dir, "kubeconfig.json"), kconf)
+	return kconf, err
+}
+
+// ServiceAccounts reads the service accounts from serviceaccounts.json.
+func (src kubeFixtures) ServiceAccounts() ([]ServiceAccount, error) {
+	l := ServiceAccountList{}
+	_, err := readFixture(filepath.Join(src.dir, "serviceaccounts.json"), &l)
+	return l.Items, err
+}
+
+// Secrets reads the secrets from secrets.json.
+func (src kubeFixtures) Secrets() ([]Secret, error) {
+	l := SecretList{}
+	_, err := readFixture(filepath.Join(src.dir, "secrets.json"), &l)
+	return l.Items, err
+}
+
+// Pods reads the pods from pods.json.
+func (src kubeFixtures) Pods() ([]Pod, error) {
+	l := PodList{}
+	_, err := readFixture(filepath.Join(src.dir, "pods.json"), &l)
+	return l.Items, err
+}
+
+// Roles reads the roles from roles.json.
+func (src kubeFixtures) Roles() ([]Role, error) {
+	l := RoleList{}
+	_, err := readFixture(filepath.Join(src.dir, "roles.json"), &l)
+	return l.Items, err
+}
+
+// ClusterRoles reads the cluster roles from clusterroles.json.
+func (src kubeFixtures) ClusterRoles() ([]ClusterRole, error) {
+	l := ClusterRoleList{}
+	_, err := readFixture(filepath.Join(src.dir, "clusterroles.json"), &l)
+	return l.Items, err
+}
+
+// RoleBindings reads the role bindings from rolebindings.json.
+func (src kubeFixtures) RoleBindings() ([]RoleBinding, error) {
+	l := RoleBindingList{}
+	_, err := readFixture(filepath.Join(src.dir, "rolebindings.json"), &l)
+	return l.Items, err
+}
+
+// ClusterRoleBindings reads the cluster role bindings from clusterrolebindings.json.
+func (src kubeFixtures) ClusterRoleBindings() ([]ClusterRoleBinding, error) {
+	l := ClusterRoleBindingList{}
+	_, err := readFixture(filepath.Join(src.dir, "clusterrolebindings.json"), &l)
+	return l.Items, err
+}
+
+// ConfigMap reads the config map from configmap-NAMESPACE-NAME.json.
+func (src kubeFixtures) ConfigMap(namespace, name string) (*ConfigMap, error) {
+	cm := &ConfigMap{}
+	found, err := readFixture(filepath.Join(src.dir, fmt.Sprintf("configmap-%v-%v.json", namespace, name)), cm)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no config map %v in fixture directory %v", namespaceit(namespace, name), src.dir)
+	}
+	return cm, nil
+}